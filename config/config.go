@@ -0,0 +1,188 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+)
+
+type Bucket struct {
+	Name string `json:"-"`
+
+	// Resize limits, in pixels; zero falls back to VIP_MAX_WIDTH and
+	// VIP_MAX_HEIGHT
+	MaxWidth  int `json:"max_width"`
+	MaxHeight int `json:"max_height"`
+
+	// Query parameters clients may use; empty allows all of them
+	Transformations []string `json:"transformations"`
+
+	// Overrides AUTH_TOKEN for uploads to this bucket
+	UploadToken string `json:"upload_token"`
+
+	// Upload size limit in megabytes; zero falls back to VIP_SIZE_LIMIT
+	SizeLimit int64 `json:"size_limit"`
+
+	// Output format used when the client doesn't ask for one
+	Format string `json:"format"`
+
+	// Overrides VIP_SIGNING_KEY for this bucket
+	SigningKey string `json:"signing_key"`
+
+	// Overrides VIP_CACHE_CONTROL for images served from this bucket
+	CacheControl string `json:"cache_control"`
+
+	// Metadata policy, "strip", "gps" or "keep"; overrides VIP_METADATA
+	Metadata string `json:"metadata"`
+
+	// Key uploads by their contents, as if VIP_DEDUPE were set
+	Dedupe bool `json:"dedupe"`
+
+	// Rules uploads to this bucket must meet
+	Validation Validation `json:"validation"`
+
+	// Named query strings clients can ask for with p, e.g.
+	// "avatar-small": "s=160&c=true"
+	Presets map[string]string `json:"presets"`
+
+	// Reject image requests that transform images other than by preset
+	PresetsOnly bool `json:"presets_only"`
+}
+
+// Validation limits what can be uploaded to a bucket. Zero values
+// don't restrict anything.
+type Validation struct {
+	// Formats detected from the file's contents, e.g. "jpeg" or "png"
+	Formats []string `json:"formats"`
+
+	// Dimensions in pixels, as displayed after EXIF orientation
+	MinWidth  int `json:"min_width"`
+	MinHeight int `json:"min_height"`
+	MaxWidth  int `json:"max_width"`
+	MaxHeight int `json:"max_height"`
+
+	MaxMegapixels float64 `json:"max_megapixels"`
+
+	// The long side divided by the short side
+	MaxAspectRatio float64 `json:"max_aspect_ratio"`
+}
+
+func (v *Validation) AllowsFormat(format string) bool {
+	if len(v.Formats) == 0 {
+		return true
+	}
+
+	for _, f := range v.Formats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Preset returns the parameters of a named preset. Presets are set by
+// the operator, so they aren't limited by Transformations.
+func (b *Bucket) Preset(name string) (url.Values, bool) {
+	query, ok := b.Presets[name]
+	if !ok {
+		return nil, false
+	}
+
+	values, _ := url.ParseQuery(query)
+	return values, true
+}
+
+func (b *Bucket) Allows(param string) bool {
+	if len(b.Transformations) == 0 {
+		return true
+	}
+
+	for _, t := range b.Transformations {
+		if t == param {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Registry struct {
+	Buckets map[string]*Bucket `json:"buckets"`
+}
+
+var (
+	mu       sync.RWMutex
+	registry *Registry
+)
+
+func Load(path string) (*Registry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &Registry{}
+	if err := json.NewDecoder(f).Decode(r); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for name, b := range r.Buckets {
+		if b == nil {
+			b = &Bucket{}
+			r.Buckets[name] = b
+		}
+		b.Name = name
+
+		for preset, query := range b.Presets {
+			if _, err := url.ParseQuery(query); err != nil {
+				return nil, fmt.Errorf("%s: bucket %s: preset %q: %s", path, name, preset, err.Error())
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// Set installs the registry consulted by Lookup. A nil registry
+// disables the allowlist so every bucket is accepted with defaults.
+func Set(r *Registry) {
+	mu.Lock()
+	registry = r
+	mu.Unlock()
+}
+
+// Names lists the configured buckets, or reports false when there's no
+// registry and so no list of them.
+func Names() ([]string, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if registry == nil {
+		return nil, false
+	}
+
+	names := make([]string, 0, len(registry.Buckets))
+	for name := range registry.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, true
+}
+
+func Lookup(name string) (*Bucket, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if registry == nil {
+		return &Bucket{Name: name}, true
+	}
+
+	b, ok := registry.Buckets[name]
+	return b, ok
+}
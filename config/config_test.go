@@ -0,0 +1,126 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	r, err := Load("../test/buckets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Buckets) != 5 {
+		t.Errorf("Expected 5 buckets; got %d", len(r.Buckets))
+	}
+
+	b := r.Buckets["avatars"]
+	if b == nil {
+		t.Fatal("Expected avatars bucket")
+	}
+
+	if b.Name != "avatars" || b.MaxWidth != 320 || b.UploadToken != "avatartoken" ||
+		b.SizeLimit != 1 || b.Format != "webp" {
+		t.Errorf("Unexpected bucket settings: %+v", b)
+	}
+
+	if !b.Allows("s") || !b.Allows("c") || b.Allows("h") {
+		t.Errorf("Unexpected transformations: %v", b.Transformations)
+	}
+
+	if !r.Buckets["samplebucket"].Allows("h") {
+		t.Error("Expected a bucket without transformations to allow all of them")
+	}
+
+	v := b.Validation
+	if !v.AllowsFormat("png") || v.AllowsFormat("gif") || v.MinWidth != 64 ||
+		v.MaxMegapixels != 12 || v.MaxAspectRatio != 2 {
+		t.Errorf("Unexpected validation: %+v", v)
+	}
+	if v := r.Buckets["samplebucket"].Validation; !v.AllowsFormat("gif") {
+		t.Error("Expected a bucket without formats to allow all of them")
+	}
+
+	if !r.Buckets["gallery"].Dedupe || r.Buckets["samplebucket"].Dedupe {
+		t.Error("Expected only the gallery bucket to dedupe uploads")
+	}
+
+	gallery := r.Buckets["gallery"]
+	if preset, ok := gallery.Preset("hero"); !ok || preset.Get("s") != "640" || preset.Get("fmt") != "webp" {
+		t.Errorf("Unexpected hero preset: %v", preset)
+	}
+	if _, ok := gallery.Preset("missing"); ok {
+		t.Error("Expected an unknown preset not to be found")
+	}
+	if !gallery.PresetsOnly || b.PresetsOnly {
+		t.Error("Expected only the gallery bucket to allow presets alone")
+	}
+}
+
+func TestLoadBadPreset(t *testing.T) {
+	f, err := ioutil.TempFile("", "buckets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"buckets": {"mybucket": {"presets": {"broken": "s=%zz"}}}}`)
+	f.Close()
+
+	if _, err := Load(f.Name()); err == nil {
+		t.Error("Expected an error for a preset that isn't a query string")
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	if _, err := Load("../test/nonexistent.json"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	Set(nil)
+	if b, ok := Lookup("anything"); !ok || b.Name != "anything" {
+		t.Error("Expected every bucket to be accepted without a registry")
+	}
+
+	r, err := Load("../test/buckets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Set(r)
+	defer Set(nil)
+
+	if _, ok := Lookup("anything"); ok {
+		t.Error("Expected an unknown bucket to be rejected")
+	}
+
+	if b, ok := Lookup("private"); !ok || b.SigningKey != "privatesecret" {
+		t.Error("Expected the private bucket to be configured")
+	}
+}
+
+func TestNames(t *testing.T) {
+	Set(nil)
+	if _, ok := Names(); ok {
+		t.Error("Expected no bucket names without a registry")
+	}
+
+	r, err := Load("../test/buckets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Set(r)
+	defer Set(nil)
+
+	names, ok := Names()
+	expected := []string{"avatars", "gallery", "places", "private", "samplebucket"}
+	if !ok || !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v; got %v", expected, names)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vokal/vip/test"
+	. "gopkg.in/check.v1"
+)
+
+var (
+	_ = Suite(&DeleteSuite{})
+)
+
+type DeleteSuite struct{}
+
+func (s *DeleteSuite) SetUpSuite(c *C) {
+	setUpSuite(c)
+}
+
+func (s *DeleteSuite) SetUpTest(c *C) {
+	setUpTest(c)
+
+	storage = test.NewStore()
+	authToken = "lalalatokenlalala"
+	origins = nil
+}
+
+func (s *DeleteSuite) router() *mux.Router {
+	// Mock up a router so that mux.Vars are passed
+	// correctly
+	m := mux.NewRouter()
+	m.Handle("/{bucket_id}/{image_id}", verifyDelete(handleDelete)).Methods("DELETE", "OPTIONS")
+	m.HandleFunc("/{bucket_id}/{image_id}", handleImageRequest)
+	return m
+}
+
+func (s *DeleteSuite) serve(c *C, method, uri, token string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, uri, nil)
+	c.Assert(err, IsNil)
+	if token != "" {
+		req.Header.Set("X-Vip-Token", token)
+	}
+
+	recorder := httptest.NewRecorder()
+	s.router().ServeHTTP(recorder, req)
+	return recorder
+}
+
+func (s *DeleteSuite) TestDelete(c *C) {
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+	err = storage.Put("samplebucket", "todelete", file, "image/jpeg")
+	c.Assert(err, IsNil)
+	err = storage.Put("samplebucket", "todeletetoo", file, "image/jpeg")
+	c.Assert(err, IsNil)
+
+	// Generate and cache a couple of derivatives
+	for _, uri := range []string{
+		"http://localhost:8080/samplebucket/todelete?s=100",
+		"http://localhost:8080/samplebucket/todelete?s=100&c=true",
+	} {
+		recorder := s.serve(c, "GET", uri, "")
+		c.Assert(recorder.Code, Equals, http.StatusOK)
+	}
+
+	// Derivatives are written in the background
+	keys, err := storage.List("samplebucket", "todelete/")
+	c.Assert(err, IsNil)
+	for i := 0; len(keys) < 2 && i < 100; i++ {
+		keys, err = storage.List("samplebucket", "todelete/")
+		c.Assert(err, IsNil)
+	}
+
+	recorder := s.serve(c, "DELETE", "http://localhost:8080/samplebucket/todelete", authToken)
+	c.Assert(recorder.Code, Equals, http.StatusNoContent)
+
+	keys, err = storage.List("samplebucket", "todelete")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"todeletetoo"})
+
+	// Copies still in groupcache are no longer served
+	recorder = s.serve(c, "GET", "http://localhost:8080/samplebucket/todelete?s=100", "")
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+
+	// Deleting again is harmless
+	recorder = s.serve(c, "DELETE", "http://localhost:8080/samplebucket/todelete", authToken)
+	c.Assert(recorder.Code, Equals, http.StatusNoContent)
+}
+
+func (s *DeleteSuite) TestUnauthorizedDelete(c *C) {
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+	err = storage.Put("samplebucket", "keepme", file, "image/jpeg")
+	c.Assert(err, IsNil)
+
+	recorder := s.serve(c, "DELETE", "http://localhost:8080/samplebucket/keepme", "")
+	c.Assert(recorder.Code, Equals, http.StatusUnauthorized)
+
+	keys, err := storage.List("samplebucket", "keepme")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"keepme"})
+}
+
+func (s *DeleteSuite) TestDeleteFromAllowedOrigin(c *C) {
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+	err = storage.Put("samplebucket", "keepme", file, "image/jpeg")
+	c.Assert(err, IsNil)
+
+	origins = []string{"example.com"}
+
+	// An allowed origin can upload without a token, but not delete
+	req, err := http.NewRequest("DELETE", "http://localhost:8080/samplebucket/keepme", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Origin", "http://example.com")
+	recorder := httptest.NewRecorder()
+	s.router().ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusUnauthorized)
+
+	keys, err := storage.List("samplebucket", "keepme")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"keepme"})
+
+	// Preflight requests still get the CORS headers
+	req, err = http.NewRequest("OPTIONS", "http://localhost:8080/samplebucket/keepme", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Origin", "http://example.com")
+	recorder = httptest.NewRecorder()
+	s.router().ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Access-Control-Allow-Methods"), Matches, ".*DELETE.*")
+}
+
+func (s *DeleteSuite) TestDeleteWithoutToken(c *C) {
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+	err = storage.Put("samplebucket", "keepme", file, "image/jpeg")
+	c.Assert(err, IsNil)
+
+	// Without AUTH_TOKEN set, an empty token mustn't match it
+	authToken = ""
+	req, err := http.NewRequest("DELETE", "http://localhost:8080/samplebucket/keepme", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("X-Vip-Token", "")
+	recorder := httptest.NewRecorder()
+	s.router().ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusUnauthorized)
+
+	keys, err := storage.List("samplebucket", "keepme")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"keepme"})
+}
+
+func (s *DeleteSuite) TestDeleteOnAnotherNode(c *C) {
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+	err = storage.Put("samplebucket", "elsewhere", file, "image/jpeg")
+	c.Assert(err, IsNil)
+
+	recorder := s.serve(c, "GET", "http://localhost:8080/samplebucket/elsewhere?s=50", "")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+
+	// Deleted without going through this node, which only finds out
+	// once it checks the original again
+	savedModified, savedDeleted := modified, deleted
+	defer func() { modified, deleted = savedModified, savedDeleted }()
+	modified = newModTimes(time.Nanosecond)
+	deleted = newKeySet(time.Millisecond)
+	c.Assert(storage.Delete("samplebucket", "elsewhere"), IsNil)
+
+	recorder = s.serve(c, "GET", "http://localhost:8080/samplebucket/elsewhere?s=50", "")
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+	c.Assert(deleted.Contains("samplebucket", "elsewhere"), Equals, true)
+
+	// Uploaded again through another node, as a deduplicated image
+	// would be, it's served once this node's record of the delete
+	// expires
+	c.Assert(storage.Put("samplebucket", "elsewhere", file, "image/jpeg"), IsNil)
+	time.Sleep(5 * time.Millisecond)
+
+	recorder = s.serve(c, "GET", "http://localhost:8080/samplebucket/elsewhere?s=50", "")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+}
+
+func (s *DeleteSuite) TestDeleteUploads(c *C) {
+	session := sessionPrefix("0123456789abcdef0123456789abcdef") + "session"
+	err := storage.Put("samplebucket", session, []byte(`{"length": 100}`), "application/json")
+	c.Assert(err, IsNil)
+
+	// Resumable uploads live in the bucket but can't be reached as images
+	recorder := s.serve(c, "DELETE", "http://localhost:8080/samplebucket/"+resumablePrefix, authToken)
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+
+	recorder = s.serve(c, "GET", "http://localhost:8080/samplebucket/"+resumablePrefix, "")
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+
+	keys, err := storage.List("samplebucket", resumablePrefix+"/")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{session})
+}
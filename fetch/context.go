@@ -5,15 +5,68 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/vokal/vip/store"
 )
 
+type Fit string
+
+const (
+	// Scale to fit inside the box, padding the remainder
+	FitContain Fit = "contain"
+	// Scale to fill the box, cropping the overflow
+	FitCover Fit = "cover"
+	// Stretch to exactly the box, ignoring aspect ratio
+	FitFill Fit = "fill"
+	// Scale to fit inside the box without padding
+	FitInside Fit = "inside"
+)
+
+func ParseFit(s string) (Fit, bool) {
+	switch f := Fit(s); f {
+	case FitContain, FitCover, FitFill, FitInside:
+		return f, true
+	}
+
+	return "", false
+}
+
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatWebP Format = "webp"
+)
+
+func ParseFormat(s string) (Format, bool) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatJPEG, FormatPNG, FormatWebP:
+		return f, true
+	case "jpg":
+		return FormatJPEG, true
+	}
+
+	return "", false
+}
+
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
 type CacheContext struct {
 	ImageId string
 	Bucket  string
 	Width   int
+	Height  int
 	Crop    bool
+	Rect    *Rect
+	Fit     Fit
+	Gravity Gravity
+	Focal   *FocalPoint
+	Format  Format
+	Quality int
 }
 
 func (c *CacheContext) ReadOriginal(s store.ImageStore) (io.ReadCloser, error) {
@@ -36,17 +89,74 @@ func (c *CacheContext) ReadModified(s store.ImageStore) (io.ReadCloser, error) {
 	return data, err
 }
 
+// WriteModified stores a derivative under its original's key. The
+// original can be deleted while the derivative is being made, in which
+// case it's removed again rather than left behind.
 func (c *CacheContext) WriteModified(buf []byte, s store.ImageStore) error {
-	return s.Put(c.Bucket, c.CacheKey(), buf, http.DetectContentType(buf))
+	err := s.Put(c.Bucket, c.CacheKey(), buf, http.DetectContentType(buf))
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.Head(c.Bucket, c.ImageId)
+	if store.KindOf(err) == store.ErrNotFound {
+		return s.Delete(c.Bucket, c.CacheKey())
+	} else if err == nil {
+		resp.Body.Close()
+	}
+
+	return nil
+}
+
+func (c *CacheContext) quality() int {
+	if c.Quality == 0 {
+		return defaultQuality
+	}
+
+	return c.Quality
+}
+
+func (c *CacheContext) Resized() bool {
+	return c.Width != 0 || c.Height != 0 || c.Rect != nil
+}
+
+// Crops reports whether the image is cut down to fill its box, the
+// only time gravity and focal points matter.
+func (c *CacheContext) Crops() bool {
+	return c.Crop || (c.Width != 0 && c.Height != 0 && c.Fit == FitCover)
 }
 
 func (c *CacheContext) CacheKey() string {
-	switch {
-	case c.Crop && c.Width != 0:
-		return fmt.Sprintf("%s/c/s/%d", c.ImageId, c.Width)
-	case c.Width != 0:
-		return fmt.Sprintf("%s/s/%d", c.ImageId, c.Width)
+	key := c.ImageId
+
+	// The region is extracted first, so it comes first
+	if c.Rect != nil {
+		key += fmt.Sprintf("/rect/%s", c.Rect)
+	}
+	if c.Crop && c.Width != 0 {
+		key += "/c"
+	}
+	if c.Width != 0 {
+		key += fmt.Sprintf("/s/%d", c.Width)
+	}
+	if c.Height != 0 {
+		key += fmt.Sprintf("/h/%d", c.Height)
+	}
+	if c.Fit != "" {
+		key += fmt.Sprintf("/fit/%s", c.Fit)
+	}
+	if c.Gravity != GravityCenter {
+		key += fmt.Sprintf("/g/%s", c.Gravity)
+	}
+	if c.Focal != nil {
+		key += fmt.Sprintf("/fx/%g/fy/%g", c.Focal.X, c.Focal.Y)
+	}
+	if c.Quality != 0 {
+		key += fmt.Sprintf("/q/%d", c.Quality)
+	}
+	if c.Format != "" {
+		key += fmt.Sprintf("/f/%s", c.Format)
 	}
 
-	return fmt.Sprintf("%s", c.ImageId)
+	return key
 }
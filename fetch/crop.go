@@ -0,0 +1,324 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/daddye/vips"
+	"github.com/disintegration/imaging"
+	"github.com/vokal/vip/store"
+)
+
+// Gravity picks the part of an image a crop keeps.
+type Gravity string
+
+const (
+	GravityCenter    Gravity = ""
+	GravityNorth     Gravity = "north"
+	GravitySouth     Gravity = "south"
+	GravityEast      Gravity = "east"
+	GravityWest      Gravity = "west"
+	GravityNorthEast Gravity = "northeast"
+	GravityNorthWest Gravity = "northwest"
+	GravitySouthEast Gravity = "southeast"
+	GravitySouthWest Gravity = "southwest"
+	// Keep the busiest part of the image
+	GravityEntropy Gravity = "entropy"
+	// Keep the part most likely to catch the eye: edges, saturated
+	// colors and skin tones
+	GravityAttention Gravity = "attention"
+)
+
+// gravityFocus places each compass gravity as a focal point.
+var gravityFocus = map[Gravity]FocalPoint{
+	GravityNorth:     {0.5, 0},
+	GravitySouth:     {0.5, 1},
+	GravityEast:      {1, 0.5},
+	GravityWest:      {0, 0.5},
+	GravityNorthEast: {1, 0},
+	GravityNorthWest: {0, 0},
+	GravitySouthEast: {1, 1},
+	GravitySouthWest: {0, 1},
+}
+
+// vipsGravity lists the gravities vips can crop to by itself.
+var vipsGravity = map[Gravity]vips.Gravity{
+	GravityNorth: vips.NORTH,
+	GravitySouth: vips.SOUTH,
+	GravityEast:  vips.EAST,
+	GravityWest:  vips.WEST,
+}
+
+func ParseGravity(s string) (Gravity, bool) {
+	g := Gravity(strings.ToLower(s))
+	switch g {
+	case "center", "centre":
+		return GravityCenter, true
+	case GravityEntropy, GravityAttention:
+		return g, true
+	}
+
+	if _, ok := gravityFocus[g]; ok {
+		return g, true
+	}
+
+	return GravityCenter, false
+}
+
+// FocalPoint is the point a crop is centered on as near as it can be,
+// given as fractions of the image's width and height.
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// ParseFocalPoint reads an "x,y" pair of fractions.
+func ParseFocalPoint(s string) (*FocalPoint, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, false
+	}
+
+	x, ok := parseFraction(parts[0])
+	if !ok {
+		return nil, false
+	}
+	y, ok := parseFraction(parts[1])
+	if !ok {
+		return nil, false
+	}
+
+	return &FocalPoint{x, y}, true
+}
+
+// parseFraction reads a number from 0 to 1, rounded so near-identical
+// points share a cache key.
+func parseFraction(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(f) || f < 0 || f > 1 {
+		return 0, false
+	}
+
+	return math.Round(f*1000) / 1000, true
+}
+
+// FocalKey is where an image's stored focal point is kept, alongside
+// its derivatives so it's deleted with them.
+func FocalKey(id string) string {
+	return id + "/focal"
+}
+
+func WriteFocalPoint(s store.ImageStore, bucket, id string, p *FocalPoint) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(bucket, FocalKey(id), data, "application/json")
+}
+
+// ReadFocalPoint returns the focal point stored for an image, or nil
+// if it doesn't have one.
+func ReadFocalPoint(s store.ImageStore, bucket, id string) (*FocalPoint, error) {
+	r, err := s.GetReader(bucket, FocalKey(id))
+	if store.KindOf(err) == store.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	p := &FocalPoint{}
+	if err := json.NewDecoder(r).Decode(p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// focus returns the focal point a crop should be centered on, and
+// whether it needs one at all rather than the center or a side vips
+// crops to itself.
+func (c *CacheContext) focus() (*FocalPoint, bool) {
+	if c.Focal != nil {
+		return c.Focal, true
+	}
+
+	if p, ok := gravityFocus[c.Gravity]; ok {
+		if _, ok := vipsGravity[c.Gravity]; !ok {
+			return &p, true
+		}
+	}
+
+	return nil, c.Gravity == GravityEntropy || c.Gravity == GravityAttention
+}
+
+// cropWindow is the largest width:height rectangle within a source
+// image, placed as close to centered on (fx, fy) as the edges allow.
+func cropWindow(srcWidth, srcHeight, width, height int, fx, fy float64) image.Rectangle {
+	scale := math.Min(float64(srcWidth)/float64(width), float64(srcHeight)/float64(height))
+	w := clamp(int(math.Round(float64(width)*scale)), 1, srcWidth)
+	h := clamp(int(math.Round(float64(height)*scale)), 1, srcHeight)
+
+	left := clamp(int(math.Round(fx*float64(srcWidth)-float64(w)/2)), 0, srcWidth-w)
+	top := clamp(int(math.Round(fy*float64(srcHeight)-float64(h)/2)), 0, srcHeight-h)
+
+	return image.Rect(left, top, left+w, top+h)
+}
+
+// focusCrop crops an image to width x height around a focal point,
+// finding one first for the entropy and attention gravities. vips can
+// only crop to the center or a side, so this is done in Go.
+func focusCrop(raw []byte, width, height, quality int, c *CacheContext) (io.Reader, error) {
+	img, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	p, _ := c.focus()
+	if p == nil {
+		p = smartFocus(img, width, height, c.Gravity)
+	}
+
+	size := img.Bounds().Size()
+	window := cropWindow(size.X, size.Y, width, height, p.X, p.Y)
+	cropped := imaging.Resize(imaging.Crop(img, window.Add(img.Bounds().Min)), width, height, imaging.Linear)
+
+	buf := new(bytes.Buffer)
+	if format == "png" {
+		err = png.Encode(buf, cropped)
+	} else {
+		err = jpeg.Encode(buf, cropped, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// smartSize is the longest side of the thumbnail smart crops are
+// worked out on. Scoring every window of the full image would be slow
+// and the detail doesn't change where the crop goes.
+const smartSize = 64
+
+// smartFocus finds the width:height window scoring highest for the
+// gravity and returns its center. Ties go to the window nearest the
+// center, so a featureless image is cropped as it would be otherwise.
+func smartFocus(img image.Image, width, height int, g Gravity) *FocalPoint {
+	size := img.Bounds().Size()
+	scale := math.Min(1, float64(smartSize)/math.Max(float64(size.X), float64(size.Y)))
+	tw := clamp(int(math.Round(float64(size.X)*scale)), 1, size.X)
+	th := clamp(int(math.Round(float64(size.Y)*scale)), 1, size.Y)
+	thumb := imaging.Resize(img, tw, th, imaging.Box)
+
+	score := windowEntropy
+	if g == GravityAttention {
+		score = windowSaliency(saliency(thumb))
+	}
+
+	best := cropWindow(tw, th, width, height, 0.5, 0.5)
+	bestScore := score(thumb, best)
+	for _, window := range slideWindow(tw, th, best.Dx(), best.Dy()) {
+		if s := score(thumb, window); s > bestScore {
+			best, bestScore = window, s
+		}
+	}
+
+	return &FocalPoint{
+		X: (float64(best.Min.X) + float64(best.Dx())/2) / float64(tw),
+		Y: (float64(best.Min.Y) + float64(best.Dy())/2) / float64(th),
+	}
+}
+
+// slideWindow lists every position of a w x h window within the image.
+// The window always spans one side, so it only moves along the other.
+func slideWindow(width, height, w, h int) []image.Rectangle {
+	var windows []image.Rectangle
+	for top := 0; top <= height-h; top++ {
+		for left := 0; left <= width-w; left++ {
+			windows = append(windows, image.Rect(left, top, left+w, top+h))
+		}
+	}
+
+	return windows
+}
+
+func luminance(img *image.NRGBA, x, y int) float64 {
+	i := img.PixOffset(x, y)
+	return 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+}
+
+// windowEntropy is the Shannon entropy of a window's luminance.
+func windowEntropy(img *image.NRGBA, r image.Rectangle) float64 {
+	var histogram [256]int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			histogram[int(luminance(img, x, y))]++
+		}
+	}
+
+	n := float64(r.Dx() * r.Dy())
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / n
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	return entropy
+}
+
+// saliency scores each pixel by how much it's likely to draw the eye,
+// adding its edge strength, saturation and a bonus for skin tones.
+func saliency(img *image.NRGBA) [][]float64 {
+	size := img.Bounds().Size()
+	scores := make([][]float64, size.Y)
+	for y := range scores {
+		scores[y] = make([]float64, size.X)
+		for x := range scores[y] {
+			i := img.PixOffset(x, y)
+			r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+
+			// Laplacian edge detection on the luminance
+			edge := 4 * luminance(img, x, y)
+			for _, d := range []image.Point{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+				nx, ny := clamp(x+d.X, 0, size.X-1), clamp(y+d.Y, 0, size.Y-1)
+				edge -= luminance(img, nx, ny)
+			}
+
+			saturation := math.Max(r, math.Max(g, b)) - math.Min(r, math.Min(g, b))
+
+			skin := 0.0
+			if r > 95 && g > 40 && b > 20 && r > g && r > b && r-math.Min(g, b) > 15 && math.Abs(r-g) > 15 {
+				skin = 255
+			}
+
+			scores[y][x] = math.Abs(edge) + saturation + skin
+		}
+	}
+
+	return scores
+}
+
+// windowSaliency scores a window by the total saliency inside it.
+func windowSaliency(scores [][]float64) func(*image.NRGBA, image.Rectangle) float64 {
+	return func(_ *image.NRGBA, r image.Rectangle) float64 {
+		total := 0.0
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				total += scores[y][x]
+			}
+		}
+
+		return total
+	}
+}
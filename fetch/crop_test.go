@@ -0,0 +1,177 @@
+package fetch
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/vokal/vip/store"
+	"github.com/vokal/vip/test"
+)
+
+// patchImage is a white image with a busy, colourful patch in it.
+func patchImage(width, height int, patch image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.ZP, draw.Src)
+
+	r := rand.New(rand.NewSource(1))
+	for y := patch.Min.Y; y < patch.Max.Y; y++ {
+		for x := patch.Min.X; x < patch.Max.X; x++ {
+			img.Set(x, y, color.NRGBA{uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), 255})
+		}
+	}
+
+	return img
+}
+
+func TestParseGravity(t *testing.T) {
+	cases := map[string]Gravity{
+		"north":     GravityNorth,
+		"SouthWest": GravitySouthWest,
+		"center":    GravityCenter,
+		"entropy":   GravityEntropy,
+		"attention": GravityAttention,
+	}
+	for s, expected := range cases {
+		if g, ok := ParseGravity(s); !ok || g != expected {
+			t.Errorf("%q: expected %q; got %q (%v)", s, expected, g, ok)
+		}
+	}
+
+	for _, s := range []string{"", "up", "smart"} {
+		if _, ok := ParseGravity(s); ok {
+			t.Errorf("%q: expected an invalid gravity", s)
+		}
+	}
+}
+
+func TestParseFocalPoint(t *testing.T) {
+	if p, ok := ParseFocalPoint("0.25, 0.8"); !ok || *p != (FocalPoint{0.25, 0.8}) {
+		t.Errorf("Expected 0.25,0.8; got %v (%v)", p, ok)
+	}
+
+	for _, s := range []string{"", "0.5", "0.5,0.5,0.5", "-0.1,0.5", "0.5,1.5", "a,b", "NaN,0"} {
+		if _, ok := ParseFocalPoint(s); ok {
+			t.Errorf("%q: expected an invalid focal point", s)
+		}
+	}
+}
+
+func TestCropWindow(t *testing.T) {
+	cases := []struct {
+		fx, fy float64
+		window image.Rectangle
+	}{
+		{0.5, 0.5, image.Rect(100, 0, 300, 200)},
+		{0, 0, image.Rect(0, 0, 200, 200)},
+		{1, 1, image.Rect(200, 0, 400, 200)},
+		{0.3, 0.5, image.Rect(20, 0, 220, 200)},
+		{0.1, 0.5, image.Rect(0, 0, 200, 200)},
+	}
+
+	for _, c := range cases {
+		if window := cropWindow(400, 200, 100, 100, c.fx, c.fy); window != c.window {
+			t.Errorf("%v,%v: expected %v; got %v", c.fx, c.fy, c.window, window)
+		}
+	}
+
+	// A wider box spans the width and moves up and down instead
+	if window := cropWindow(400, 200, 300, 100, 0.5, 0); window != image.Rect(0, 0, 400, 133) {
+		t.Errorf("Expected the window to span the width; got %v", window)
+	}
+}
+
+func TestSmartFocus(t *testing.T) {
+	img := patchImage(300, 100, image.Rect(230, 10, 290, 90))
+
+	for _, g := range []Gravity{GravityEntropy, GravityAttention} {
+		if p := smartFocus(img, 100, 100, g); p.X < 0.66 {
+			t.Errorf("%s: expected a focus over the patch; got %v", g, p)
+		}
+	}
+
+	// Without anything to find, crops stay in the center
+	blank := patchImage(300, 100, image.ZR)
+	for _, g := range []Gravity{GravityEntropy, GravityAttention} {
+		if p := smartFocus(blank, 100, 100, g); p.X < 0.45 || p.X > 0.55 {
+			t.Errorf("%s: expected a centered focus; got %v", g, p)
+		}
+	}
+}
+
+func TestFocusCrop(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, patchImage(300, 100, image.Rect(230, 10, 290, 90))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*CacheContext{
+		{Width: 100, Crop: true, Gravity: GravityNorthEast},
+		{Width: 100, Crop: true, Gravity: GravityAttention},
+		{Width: 100, Crop: true, Focal: &FocalPoint{0.9, 0.5}},
+		{Width: 80, Height: 80, Fit: FitCover, Gravity: GravityEntropy},
+	} {
+		resized, err := Resize(bytes.NewReader(buf.Bytes()), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img, _, err := image.Decode(resized)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size := img.Bounds().Size()
+		if size.X != size.Y {
+			t.Errorf("%s: expected a square; got %v", c.CacheKey(), size)
+		}
+		if r, g, b, _ := img.At(size.X/2, size.Y/2).RGBA(); r == 0xffff && g == 0xffff && b == 0xffff {
+			t.Errorf("%s: expected the patch in the middle of the crop", c.CacheKey())
+		}
+	}
+}
+
+// focalStore can't read stored focal points, as S3 reports a missing
+// key without permission to list the bucket.
+type focalStore struct {
+	*test.Store
+}
+
+func (s focalStore) GetReader(bucket, key string) (io.ReadCloser, error) {
+	if strings.HasSuffix(key, "/focal") {
+		return nil, &store.Error{Kind: store.ErrForbidden, Err: errors.New("access denied")}
+	}
+
+	return s.Store.GetReader(bucket, key)
+}
+
+func TestImageDataFocalError(t *testing.T) {
+	raw, err := ioutil.ReadFile("../test/awesome-small.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := focalStore{test.NewStore()}
+	if err := s.Put("bucket", "abc", raw, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The crop falls back to the center
+	data, err := ImageData(s, &CacheContext{ImageId: "abc", Bucket: "bucket", Width: 50, Crop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width != 50 || config.Height != 50 {
+		t.Errorf("Expected a 50x50 crop; got %dx%d (%v)", config.Width, config.Height, err)
+	}
+}
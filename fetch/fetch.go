@@ -5,43 +5,220 @@ import (
 	"errors"
 	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/vokal/vip/config"
 	"github.com/vokal/vip/store"
 
 	"github.com/golang/groupcache"
 	"github.com/gorilla/mux"
 )
 
-var maxWidth = getMaxWidth()
+var ErrUnsupportedFormat = errors.New("unsupported image format")
 
-func getMaxWidth() int {
-	maxWidth, err := strconv.Atoi(os.Getenv("VIP_MAX_WIDTH"))
+// transformable lists the originals vip can resize or convert.
+var transformable = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+var (
+	maxWidth  = getMaxWidth()
+	maxHeight = getMaxHeight()
+
+	defaultQuality, minQuality, maxQuality = getQuality()
+
+	maxGifPixels = getEnvInt("VIP_GIF_MAX_PIXELS", 50000000)
+)
+
+// maxDPR is the highest device pixel ratio a request can ask for.
+const maxDPR = 4
+
+func getEnvInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
 	if err != nil {
-		return 720
+		return fallback
+	}
+
+	return value
+}
+
+func getMaxWidth() int {
+	return getEnvInt("VIP_MAX_WIDTH", 720)
+}
+
+func getMaxHeight() int {
+	return getEnvInt("VIP_MAX_HEIGHT", 720)
+}
+
+func getQuality() (int, int, int) {
+	min := getEnvInt("VIP_QUALITY_MIN", 20)
+	max := getEnvInt("VIP_QUALITY_MAX", 95)
+	if min < 1 {
+		min = 1
+	}
+	if max > 100 || max < min {
+		max = 100
 	}
 
-	return maxWidth
+	return clamp(getEnvInt("VIP_QUALITY", 80), min, max), min, max
 }
 
+func clamp(value, min, max int) int {
+	switch {
+	case value < min:
+		return min
+	case value > max:
+		return max
+	}
+
+	return value
+}
+
+// TransformParams lists the query parameters that change the image
+// served, which buckets may restrict.
+var TransformParams = []string{"s", "h", "c", "rect", "dpr", "fit", "g", "fx", "fy", "fmt", "q"}
+
 func RequestContext(r *http.Request) *CacheContext {
 	vars := mux.Vars(r)
 
-	width, _ := strconv.Atoi(r.FormValue("s"))
+	bucket, ok := config.Lookup(vars["bucket_id"])
+	if !ok {
+		bucket = &config.Bucket{}
+	}
+
+	// A preset's parameters take the place of the request's, and
+	// parameters the bucket doesn't allow are ignored
+	preset, _ := bucket.Preset(r.FormValue("p"))
+	param := func(name string) string {
+		if v := preset.Get(name); v != "" {
+			return v
+		}
+		if !bucket.Allows(name) || bucket.PresetsOnly {
+			return ""
+		}
+		return r.FormValue(name)
+	}
+
+	width, _ := strconv.Atoi(param("s"))
+	height, _ := strconv.Atoi(param("h"))
+	if width < 0 {
+		width = 0
+	}
+	if height < 0 {
+		height = 0
+	}
+
+	// The size is scaled before it's limited, so a higher density can't
+	// get past the limits. The ratio isn't kept in the key, letting
+	// s=200&dpr=2 share a derivative with s=400.
+	if dpr, err := strconv.ParseFloat(param("dpr"), 64); err == nil && dpr > 1 {
+		dpr = math.Min(dpr, maxDPR)
+		width = int(math.Round(float64(width) * dpr))
+		height = int(math.Round(float64(height) * dpr))
+	}
+
+	maxWidth, maxHeight := maxWidth, maxHeight
+	if bucket.MaxWidth > 0 {
+		maxWidth = bucket.MaxWidth
+	}
+	if bucket.MaxHeight > 0 {
+		maxHeight = bucket.MaxHeight
+	}
 
+	// Shrink oversized boxes proportionally so the requested
+	// aspect ratio survives the clamp
 	if width > maxWidth {
+		height = height * maxWidth / width
 		width = maxWidth
 	}
+	if height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
 
-	return &CacheContext{
+	c := &CacheContext{
 		ImageId: vars["image_id"],
 		Bucket:  vars["bucket_id"],
 		Width:   width,
-		Crop:    strings.ToLower(r.FormValue("c")) == "true",
+		Height:  height,
+		Crop:    strings.ToLower(param("c")) == "true",
+	}
+	c.Rect, _ = ParseRect(param("rect"))
+
+	// Fit only matters when both dimensions are given; default to
+	// filling the box so c=true and a bare box behave the same
+	if c.Width != 0 && c.Height != 0 {
+		fit, ok := ParseFit(strings.ToLower(param("fit")))
+		if !ok {
+			fit = FitCover
+		}
+		c.Fit = fit
+		c.Crop = false
+	} else if c.Width == 0 {
+		c.Crop = false
+	}
+
+	// A focal point wins over a gravity, and either is left out of the
+	// key when nothing is cropped
+	if c.Crops() {
+		if fx, fy := param("fx"), param("fy"); fx != "" || fy != "" {
+			if fx == "" {
+				fx = "0.5"
+			}
+			if fy == "" {
+				fy = "0.5"
+			}
+			c.Focal, _ = ParseFocalPoint(fx + "," + fy)
+		}
+		if c.Focal == nil {
+			c.Gravity, _ = ParseGravity(param("g"))
+		}
 	}
+
+	if format, ok := ParseFormat(param("fmt")); ok {
+		c.Format = format
+	} else if format = negotiateFormat(r.Header.Get("Accept")); format != "" {
+		c.Format = format
+	} else if format, ok = ParseFormat(bucket.Format); ok {
+		c.Format = format
+	}
+
+	// Quality only applies when vip encodes a lossy image, and the
+	// default is left out so it shares a key with unqualified requests
+	if quality, err := strconv.Atoi(param("q")); err == nil {
+		c.Quality = clamp(quality, minQuality, maxQuality)
+	}
+	if c.Quality == defaultQuality || c.Format == FormatPNG || (!c.Resized() && c.Format == "") {
+		c.Quality = 0
+	}
+
+	return c
+}
+
+// negotiateFormat picks WebP for clients that explicitly list it in
+// their Accept header; everyone else keeps the stored format.
+func negotiateFormat(accept string) Format {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != FormatWebP.ContentType() {
+			continue
+		}
+
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+
+		return FormatWebP
+	}
+
+	return ""
 }
 
 func readImage(r io.Reader) ([]byte, error) {
@@ -66,29 +243,69 @@ func ImageData(storage store.ImageStore, gc groupcache.Context) ([]byte, error)
 		}
 	}()
 
-	resp, err := storage.Head(c.Bucket, c.ImageId)
+	reader, err = c.ReadModified(storage)
+	if err == nil {
+		log.Println("Retrieved resized image from S3")
+		data, err := readImage(reader)
+		if err != nil {
+			return nil, err
+		}
+		return c.stripMetadata(data)
+	}
+
+	reader, err = c.ReadOriginal(storage)
 	if err != nil {
-		// Don't break on an error
-		log.Println(err)
+		return nil, err
 	}
 
-	reader, err = c.ReadModified(storage)
+	raw, err := readImage(reader)
 	if err != nil {
-		reader, err = c.ReadOriginal(storage)
+		return nil, err
+	}
+
+	content := http.DetectContentType(raw)
+	if !transformable[content] {
+		return nil, ErrUnsupportedFormat
+	}
+	transform := c.Resized() || c.Format != ""
+	size, err := CheckSize(raw)
+	if err == ErrTooLarge && !transform {
+		// Originals are served as they are, without being decoded
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if transform {
+		release := Reserve(size)
+		defer release()
+	}
+
+	// A focal point stored at upload is used when the request doesn't
+	// ask for a crop of its own. It's part of the image, like its ID,
+	// so it's left out of the key. It doesn't apply within a region.
+	resize := c
+	if c.Crops() && c.Gravity == GravityCenter && c.Focal == nil && c.Rect == nil {
+		// S3 answers 403 rather than 404 for a missing key without
+		// permission to list the bucket, so no error is fatal here
+		focal, err := ReadFocalPoint(storage, c.Bucket, c.ImageId)
 		if err != nil {
-			return nil, err
+			log.Printf("Focal point of %s/%s not read, cropping to the center: %s", c.Bucket, c.ImageId, err.Error())
+		}
+		if focal != nil {
+			stored := *c
+			stored.Focal = focal
+			resize = &stored
 		}
-	} else {
-		log.Println("Retrieved resized image from S3")
-		return readImage(reader)
 	}
 
-	var buf io.Reader
-	if c.Width != 0 {
-		if resp != nil && resp.Header.Get("Content-Type") == "image/gif" {
-			buf, err = ResizeGif(reader, c)
+	var buf io.Reader = bytes.NewReader(raw)
+	if c.Resized() {
+		if content == "image/gif" {
+			buf, err = ResizeGif(buf, resize)
 		} else {
-			buf, err = Resize(reader, c)
+			buf, err = Resize(buf, resize)
 		}
 		if err != nil {
 			return nil, err
@@ -100,6 +317,25 @@ func ImageData(storage store.ImageStore, gc groupcache.Context) ([]byte, error)
 		return nil, err
 	}
 
+	// Animations only survive as GIFs, so they're never converted
+	animated := http.DetectContentType(result) == "image/gif" && animatedGif(result)
+	if c.Format != "" && !animated {
+		buf, err = Convert(bytes.NewReader(result), c.Format, c.quality())
+		if err != nil {
+			return nil, err
+		}
+
+		result, err = readImage(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err = c.stripMetadata(result)
+	if err != nil {
+		return nil, err
+	}
+
 	go func() {
 		err = c.WriteModified(result, storage)
 		if err != nil {
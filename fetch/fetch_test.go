@@ -1,9 +1,22 @@
 package fetch
 
 import (
+	"bytes"
 	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	_ "image/png"
+	"io/ioutil"
+	"math"
+	"net/http"
 	"os"
 	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/vokal/vip/config"
+	"github.com/vokal/vip/store"
+	"github.com/vokal/vip/test"
 )
 
 func TestGetMaxWidth(t *testing.T) {
@@ -24,60 +37,499 @@ func TestGetMaxWidth(t *testing.T) {
 	}
 }
 
-func TestNeedsRotation(t *testing.T) {
-	for i := 1; i <= 8; i++ {
-		filename := fmt.Sprintf("f%d-exif.jpg", i)
-		f, err := os.Open(fmt.Sprintf("../test/%s", filename))
+func TestGetQuality(t *testing.T) {
+	os.Setenv("VIP_QUALITY", "")
+	os.Setenv("VIP_QUALITY_MIN", "")
+	os.Setenv("VIP_QUALITY_MAX", "")
+	if def, min, max := getQuality(); def != 80 || min != 20 || max != 95 {
+		t.Errorf("Expected 80, 20, 95; got %d, %d, %d", def, min, max)
+	}
+
+	os.Setenv("VIP_QUALITY", "60")
+	os.Setenv("VIP_QUALITY_MIN", "40")
+	os.Setenv("VIP_QUALITY_MAX", "90")
+	if def, min, max := getQuality(); def != 60 || min != 40 || max != 90 {
+		t.Errorf("Expected 60, 40, 90; got %d, %d, %d", def, min, max)
+	}
+
+	// The default is clamped to the configured range
+	os.Setenv("VIP_QUALITY", "99")
+	if def, _, _ := getQuality(); def != 90 {
+		t.Errorf("Expected 90; got %d", def)
+	}
+
+	os.Setenv("VIP_QUALITY", "")
+	os.Setenv("VIP_QUALITY_MIN", "")
+	os.Setenv("VIP_QUALITY_MAX", "")
+}
+
+func TestRequestContext(t *testing.T) {
+	maxWidth, maxHeight = 720, 720
+	defaultQuality, minQuality, maxQuality = 80, 20, 95
+
+	cases := map[string]string{
+		"":                         "id",
+		"?s=200":                   "id/s/200",
+		"?s=200&c=true":            "id/c/s/200",
+		"?c=true":                  "id",
+		"?h=100":                   "id/h/100",
+		"?h=100&c=true":            "id/h/100",
+		"?s=300&h=200":             "id/s/300/h/200/fit/cover",
+		"?s=300&h=200&c=true":      "id/s/300/h/200/fit/cover",
+		"?s=300&h=200&fit=fill":    "id/s/300/h/200/fit/fill",
+		"?s=300&h=200&fit=INSIDE":  "id/s/300/h/200/fit/inside",
+		"?s=300&h=200&fit=bogus":   "id/s/300/h/200/fit/cover",
+		"?s=300&fit=contain":       "id/s/300",
+		"?s=1440&h=810":            "id/s/720/h/405/fit/cover",
+		"?s=500&h=1000&fit=inside": "id/s/360/h/720/fit/inside",
+		"?s=-5&h=-5":               "id",
+		"?s=200&fmt=webp":          "id/s/200/f/webp",
+		"?fmt=JPG":                 "id/f/jpeg",
+		"?fmt=gif":                 "id",
+		"?s=200&q=50":              "id/s/200/q/50",
+		"?s=200&q=80":              "id/s/200",
+		"?s=200&q=5":               "id/s/200/q/20",
+		"?s=200&q=100":             "id/s/200/q/95",
+		"?s=200&q=high":            "id/s/200",
+		"?q=50":                    "id",
+		"?q=50&fmt=webp":           "id/q/50/f/webp",
+		"?s=200&q=50&fmt=png":      "id/s/200/f/png",
+	}
+
+	for query, key := range cases {
+		r, err := http.NewRequest("GET", "http://localhost/bucket/id"+query, nil)
 		if err != nil {
-			t.Errorf("Could not open %s.", filename)
+			t.Fatal(err)
 		}
 
-		angle := needsRotation(f)
+		m := mux.NewRouter()
+		m.HandleFunc("/{bucket_id}/{image_id}", func(w http.ResponseWriter, r *http.Request) {
+			if k := RequestContext(r).CacheKey(); k != key {
+				t.Errorf("%q: expected key %s; got %s", query, key, k)
+			}
+		})
+		m.ServeHTTP(nil, r)
+	}
+}
+
+func TestRequestContextCrop(t *testing.T) {
+	maxWidth, maxHeight = 720, 720
 
-		switch i {
-		case 6:
-			if angle != 270 {
-				t.Errorf("Expected 270; got %d", angle)
+	cases := map[string]string{
+		"?s=200&c=true&g=north":             "id/c/s/200/g/north",
+		"?s=200&c=true&g=Centre":            "id/c/s/200",
+		"?s=200&c=true&g=up":                "id/c/s/200",
+		"?s=300&h=200&g=entropy":            "id/s/300/h/200/fit/cover/g/entropy",
+		"?s=300&h=200&g=southeast&fit=fill": "id/s/300/h/200/fit/fill",
+		"?s=200&g=north":                    "id/s/200",
+		"?s=200&c=true&fx=0.25&fy=0.1":      "id/c/s/200/fx/0.25/fy/0.1",
+		"?s=200&c=true&fx=0.33333":          "id/c/s/200/fx/0.333/fy/0.5",
+		"?s=200&c=true&fx=2&g=south":        "id/c/s/200/g/south",
+		"?s=200&c=true&fx=0.2&g=south":      "id/c/s/200/fx/0.2/fy/0.5",
+		"?rect=10,20,100,50&s=40&c=true":    "id/rect/10,20,100,50/c/s/40",
+		"?rect=10%25,10%25,50%25,50%25":     "id/rect/pct/10,10,50,50",
+		"?rect=10,10,0,5":                   "id",
+		"?rect=10%25,10,5,5&s=40":           "id/s/40",
+	}
+
+	for query, key := range cases {
+		r, err := http.NewRequest("GET", "http://localhost/bucket/id"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := mux.NewRouter()
+		m.HandleFunc("/{bucket_id}/{image_id}", func(w http.ResponseWriter, r *http.Request) {
+			if k := RequestContext(r).CacheKey(); k != key {
+				t.Errorf("%q: expected key %s; got %s", query, key, k)
 			}
-		case 3:
-			if angle != 180 {
-				t.Errorf("Expected 180; got %d", angle)
+		})
+		m.ServeHTTP(nil, r)
+	}
+}
+
+func TestRequestContextDPR(t *testing.T) {
+	maxWidth, maxHeight = 720, 720
+
+	cases := map[string]string{
+		"?s=200&dpr=2":         "id/s/400",
+		"?s=400":               "id/s/400",
+		"?s=200&h=100&dpr=1.5": "id/s/300/h/150/fit/cover",
+		"?s=200&c=true&dpr=3":  "id/c/s/600",
+		"?h=101&dpr=2.5":       "id/h/253",
+		"?s=1000&dpr=2":        "id/s/720",
+		"?s=720&dpr=4":         "id/s/720",
+		"?s=600&h=300&dpr=2":   "id/s/720/h/360/fit/cover",
+		"?s=1440":              "id/s/720",
+		"?s=100&dpr=9":         "id/s/400",
+		"?s=200&dpr=9":         "id/s/720",
+		"?s=200&dpr=0.5":       "id/s/200",
+		"?s=200&dpr=retina":    "id/s/200",
+		"?dpr=2":               "id",
+	}
+
+	for query, key := range cases {
+		r, err := http.NewRequest("GET", "http://localhost/bucket/id"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := mux.NewRouter()
+		m.HandleFunc("/{bucket_id}/{image_id}", func(w http.ResponseWriter, r *http.Request) {
+			if k := RequestContext(r).CacheKey(); k != key {
+				t.Errorf("%q: expected key %s; got %s", query, key, k)
 			}
-		case 8:
-			if angle != 90 {
-				t.Errorf("Expected 90; got %d", angle)
+		})
+		m.ServeHTTP(nil, r)
+	}
+
+	// A bucket's own limits hold as well
+	config.Set(&config.Registry{Buckets: map[string]*config.Bucket{
+		"capped": {Name: "capped", MaxWidth: 320},
+	}})
+	defer config.Set(nil)
+
+	r, err := http.NewRequest("GET", "http://localhost/capped/id?s=320&dpr=4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := mux.NewRouter()
+	m.HandleFunc("/{bucket_id}/{image_id}", func(w http.ResponseWriter, r *http.Request) {
+		if k := RequestContext(r).CacheKey(); k != "id/s/320" {
+			t.Errorf("Expected key id/s/320; got %s", k)
+		}
+	})
+	m.ServeHTTP(nil, r)
+}
+
+func TestRequestContextBucket(t *testing.T) {
+	maxWidth, maxHeight = 720, 720
+
+	registry, err := config.Load("../test/buckets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Set(registry)
+	defer config.Set(nil)
+
+	cases := map[string]string{
+		"?s=200":         "id/s/200/f/webp",
+		"?s=500&c=true":  "id/c/s/320/f/webp",
+		"?s=200&h=100":   "id/s/200/f/webp",
+		"?s=200&fmt=png": "id/s/200/f/webp",
+		"?s=200&dpr=2":   "id/s/200/f/webp",
+	}
+
+	for query, key := range cases {
+		r, err := http.NewRequest("GET", "http://localhost/avatars/id"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := mux.NewRouter()
+		m.HandleFunc("/{bucket_id}/{image_id}", func(w http.ResponseWriter, r *http.Request) {
+			if k := RequestContext(r).CacheKey(); k != key {
+				t.Errorf("%q: expected key %s; got %s", query, key, k)
 			}
-		default:
-			if angle != 0 {
-				t.Errorf("Expected 0; got %d", angle)
+		})
+		m.ServeHTTP(nil, r)
+	}
+}
+
+func TestRequestContextPreset(t *testing.T) {
+	maxWidth, maxHeight = 720, 720
+
+	registry, err := config.Load("../test/buckets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Set(registry)
+	defer config.Set(nil)
+
+	// A preset resolves to the same key as its parameters would
+	cases := map[string]string{
+		"/avatars/id?p=small":        "id/c/s/64/g/north/f/webp",
+		"/avatars/id?p=small&s=100":  "id/c/s/64/g/north/f/webp",
+		"/avatars/id?p=missing&s=99": "id/s/99/f/webp",
+		"/gallery/id?p=thumb":        "id/c/s/160",
+		"/gallery/id?p=hero":         "id/s/640/h/360/fit/cover/f/webp",
+		"/gallery/id?s=160&c=true":   "id",
+	}
+
+	for uri, key := range cases {
+		r, err := http.NewRequest("GET", "http://localhost"+uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := mux.NewRouter()
+		m.HandleFunc("/{bucket_id}/{image_id}", func(w http.ResponseWriter, r *http.Request) {
+			if k := RequestContext(r).CacheKey(); k != key {
+				t.Errorf("%q: expected key %s; got %s", uri, key, k)
 			}
+		})
+		m.ServeHTTP(nil, r)
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := map[string]Format{
+		"":                                   "",
+		"*/*":                                "",
+		"image/png,image/*;q=0.8,*/*;q=0.5":  "",
+		"image/webp,image/apng,image/*,*/*":  FormatWebP,
+		"image/avif, image/webp;q=0.9, */*":  FormatWebP,
+		"image/webp;q=0, image/*;q=0.8, */*": "",
+		"text/html, image/webp;q=bogus, */*": FormatWebP,
+	}
+
+	for accept, format := range cases {
+		if f := negotiateFormat(accept); f != format {
+			t.Errorf("%q: expected %q; got %q", accept, format, f)
+		}
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	for i := 1; i <= 8; i++ {
+		filename := fmt.Sprintf("f%d-exif.jpg", i)
+		f, err := os.Open(fmt.Sprintf("../test/%s", filename))
+		if err != nil {
+			t.Errorf("Could not open %s.", filename)
 		}
+
+		if o := orientation(f); o != i {
+			t.Errorf("%s: expected %d; got %d", filename, i, o)
+		}
+		f.Close()
 	}
 }
 
-func TestNeedsRotationAltFiles(t *testing.T) {
-	filenames := map[int]string{
-		1: "awesome.jpeg",
-		2: "exif_test_img.jpg",
+func TestOrientationAltFiles(t *testing.T) {
+	filenames := map[string]int{
+		"awesome.jpeg":         1,
+		"exif_test_img.jpg":    6,
+		"animated.gif":         1,
+		"test_inspiration.png": 1,
 	}
 
-	for key, filename := range filenames {
+	for filename, expected := range filenames {
 		f, err := os.Open(fmt.Sprintf("../test/%s", filename))
 		if err != nil {
 			t.Errorf("Could not open %s.", filename)
 		}
 
-		angle := needsRotation(f)
+		if o := orientation(f); o != expected {
+			t.Errorf("%s: expected %d; got %d", filename, expected, o)
+		}
+		f.Close()
+	}
+}
+
+func TestUprightSize(t *testing.T) {
+	upright := orientedPixels(t, 1).Bounds().Size()
+
+	for i := 1; i <= 8; i++ {
+		raw, err := ioutil.ReadFile(fmt.Sprintf("../test/f%d-exif.jpg", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := CheckSize(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		switch key {
-		case 1:
-			if angle != 0 {
-				t.Errorf("Expected 0; got %d", angle)
-			}
-		case 2:
-			if angle != 270 {
-				t.Errorf("Expected 270; got %d", angle)
-			}
+		if w, h := UprightSize(raw, config); w != upright.X || h != upright.Y {
+			t.Errorf("f%d: expected %v; got %dx%d", i, upright, w, h)
+		}
+	}
+}
+
+// orientedPixels decodes one of the f1..f8 test images upright.
+func orientedPixels(t *testing.T, i int) image.Image {
+	f, err := os.Open(fmt.Sprintf("../test/f%d-exif.jpg", i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, _, err := GetRotatedImage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return img
+}
+
+// pixelDiff is the mean difference between two images' channels, on
+// a scale of 0 to 255.
+func pixelDiff(a, b image.Image) float64 {
+	var total float64
+	for y := 0; y < a.Bounds().Dy(); y++ {
+		for x := 0; x < a.Bounds().Dx(); x++ {
+			r1, g1, b1, _ := a.At(a.Bounds().Min.X+x, a.Bounds().Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(b.Bounds().Min.X+x, b.Bounds().Min.Y+y).RGBA()
+			total += math.Abs(float64(r1)-float64(r2)) +
+				math.Abs(float64(g1)-float64(g2)) +
+				math.Abs(float64(b1)-float64(b2))
+		}
+	}
+
+	return total / 257 / 3 / float64(a.Bounds().Dx()*a.Bounds().Dy())
+}
+
+func TestGetRotatedImagePixels(t *testing.T) {
+	// f1 is stored upright; every other orientation should match it
+	upright := orientedPixels(t, 1)
+
+	// f2 as stored is mirrored, so it must not pass for upright
+	f, err := os.Open("../test/f2-exif.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirrored, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := pixelDiff(mirrored, upright); diff < 8 {
+		t.Errorf("f2: expected the stored pixels to differ from f1; got %.1f", diff)
+	}
+
+	for i := 2; i <= 8; i++ {
+		img := orientedPixels(t, i)
+		if img.Bounds().Size() != upright.Bounds().Size() {
+			t.Errorf("f%d: expected %v; got %v", i, upright.Bounds().Size(), img.Bounds().Size())
+			continue
+		}
+
+		if diff := pixelDiff(img, upright); diff > 8 {
+			t.Errorf("f%d: differs from f1 by %.1f", i, diff)
+		}
+	}
+}
+
+func TestAutoOrient(t *testing.T) {
+	upright := orientedPixels(t, 1)
+
+	for i := 1; i <= 8; i++ {
+		raw, err := ioutil.ReadFile(fmt.Sprintf("../test/f%d-exif.jpg", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		oriented, err := AutoOrient(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && !bytes.Equal(oriented, raw) {
+			t.Error("f1: expected an upright image to be left alone")
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(oriented))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o := orientation(bytes.NewReader(oriented)); o != 1 {
+			t.Errorf("f%d: expected orientation 1 after AutoOrient; got %d", i, o)
+		}
+		if diff := pixelDiff(img, upright); img.Bounds().Size() != upright.Bounds().Size() || diff > 8 {
+			t.Errorf("f%d: doesn't match f1 after AutoOrient", i)
 		}
 	}
 }
+
+func TestResizeGifBudget(t *testing.T) {
+	file, err := ioutil.ReadFile("../test/animated.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	budget := maxGifPixels
+	defer func() { maxGifPixels = budget }()
+
+	// Two 1024x640 frames don't fit, so only the first is resized
+	maxGifPixels = 1024 * 640
+	resized, err := ResizeGif(bytes.NewReader(file), &CacheContext{Width: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(resized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := http.DetectContentType(data); content != "image/jpeg" {
+		t.Errorf("Expected a still image/jpeg; got %s", content)
+	}
+}
+
+func TestWriteModifiedAfterDelete(t *testing.T) {
+	s := test.NewStore()
+	c := &CacheContext{ImageId: "abc", Bucket: "bucket", Width: 100}
+
+	if err := s.Put("bucket", "abc", []byte("original"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteModified([]byte("resized"), s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Head("bucket", c.CacheKey()); err != nil {
+		t.Errorf("Expected the derivative to be stored; got %v", err)
+	}
+
+	// A derivative finished after its original was deleted isn't kept
+	if err := s.Delete("bucket", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteModified([]byte("resized"), s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Head("bucket", c.CacheKey()); store.KindOf(err) != store.ErrNotFound {
+		t.Errorf("Expected the derivative to be removed; got %v", err)
+	}
+}
+
+func TestResizeGifPalettes(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+
+	// The second frame only covers the right half, with a palette that
+	// has no red in it
+	first := image.NewPaletted(image.Rect(0, 0, 20, 20), color.Palette{red, color.RGBA{0, 255, 0, 255}})
+	second := image.NewPaletted(image.Rect(10, 0, 20, 20), color.Palette{blue, color.RGBA{255, 255, 0, 255}})
+	src := &gif.GIF{
+		Image:    []*image.Paletted{first, second},
+		Delay:    []int{10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+		Config:   image.Config{Width: 20, Height: 20},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	resized, err := ResizeGif(buf, &CacheContext{Width: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(resized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 2 {
+		t.Fatalf("Expected 2 frames; got %d", len(g.Image))
+	}
+
+	// The first frame still shows on the left of the second
+	frame := g.Image[1]
+	if c := color.RGBAModel.Convert(frame.At(1, 5)); c != red {
+		t.Errorf("Expected red on the left; got %v", c)
+	}
+	if c := color.RGBAModel.Convert(frame.At(8, 5)); c != blue {
+		t.Errorf("Expected blue on the right; got %v", c)
+	}
+}
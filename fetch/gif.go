@@ -0,0 +1,268 @@
+package fetch
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// ResizeGif resizes every frame of an animated GIF. Still images, and
+// animations over the VIP_GIF_MAX_PIXELS budget, are resized through
+// vips from their first frame instead.
+func ResizeGif(src io.Reader, c *CacheContext) (io.Reader, error) {
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := CheckSize(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames decode to one byte a pixel, but compositing and resizing
+	// each of them is what costs memory and time. Frames are counted
+	// first since decoding them all is itself unbounded.
+	frames := gifFrames(raw)
+	pixels := config.Width * config.Height * frames
+	if frames > 1 && pixels > maxGifPixels {
+		log.Printf("gif: %d frames of %dx%d is over the pixel budget, resizing the first frame only",
+			frames, config.Width, config.Height)
+	}
+	if frames < 2 || pixels > maxGifPixels {
+		first, err := gif.Decode(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+
+		pngBuf := new(bytes.Buffer)
+		if err := png.Encode(pngBuf, first); err != nil {
+			return nil, err
+		}
+
+		return Resize(pngBuf, c)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames are composited onto the full canvas, so a region is cut
+	// from each of those
+	region := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if c.Rect != nil {
+		if region, err = c.Rect.bounds(g.Config.Width, g.Config.Height); err != nil {
+			return nil, err
+		}
+	}
+
+	width, height, transform := gifTransform(region.Dx(), region.Dy(), c)
+
+	out := &gif.GIF{
+		LoopCount: g.LoopCount,
+		Config: image.Config{
+			ColorModel: g.Config.ColorModel,
+			Width:      width,
+			Height:     height,
+		},
+		BackgroundIndex: g.BackgroundIndex,
+	}
+
+	// Each frame is composited onto the full canvas before resizing, so
+	// every output frame is complete and simply replaces the last one
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	palette := gifPalette(g)
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		var resized image.Image = canvas
+		if c.Rect != nil {
+			resized = imaging.Crop(canvas, region)
+		}
+		resized = transform(resized)
+		paletted := image.NewPaletted(resized.Bounds(), palette)
+		draw.Draw(paletted, paletted.Bounds(), resized, resized.Bounds().Min, draw.Src)
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, g.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, out); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// gifTransform works out the output size of a GIF and returns the
+// function that resizes each composited frame to it, matching what
+// Resize asks of vips for other images.
+func gifTransform(srcWidth, srcHeight int, c *CacheContext) (int, int, func(image.Image) image.Image) {
+	scale := func(width, height int) func(image.Image) image.Image {
+		return func(img image.Image) image.Image {
+			return imaging.Resize(img, width, height, imaging.Linear)
+		}
+	}
+
+	// Fill the box and crop the overflow around the focal point. Frames
+	// differ, so the smart gravities keep to the center.
+	focus := FocalPoint{0.5, 0.5}
+	if p, ok := gravityFocus[c.Gravity]; ok {
+		focus = p
+	}
+	if c.Focal != nil {
+		focus = *c.Focal
+	}
+	cover := func(width, height int) func(image.Image) image.Image {
+		f := math.Max(float64(width)/float64(srcWidth), float64(height)/float64(srcHeight))
+		w := int(math.Ceil(float64(srcWidth) * f))
+		h := int(math.Ceil(float64(srcHeight) * f))
+		window := cropWindow(w, h, width, height, focus.X, focus.Y)
+
+		return func(img image.Image) image.Image {
+			return imaging.Crop(imaging.Resize(img, w, h, imaging.Linear), window)
+		}
+	}
+
+	// The size of the source shrunk to fit a box, never enlarged
+	inside := func(width, height int) (int, int) {
+		f := math.Min(float64(width)/float64(srcWidth), float64(height)/float64(srcHeight))
+		if f >= 1 {
+			return srcWidth, srcHeight
+		}
+		return int(math.Floor(float64(srcWidth) * f)), int(math.Floor(float64(srcHeight) * f))
+	}
+
+	switch {
+	case c.Width != 0 && c.Height != 0:
+		width, height := shrinkBox(c.Width, c.Height, srcWidth, srcHeight)
+
+		switch c.Fit {
+		case FitFill:
+			return width, height, scale(width, height)
+		case FitInside:
+			w, h := inside(c.Width, c.Height)
+			return w, h, scale(w, h)
+		case FitContain:
+			w, h := inside(width, height)
+			return width, height, func(img image.Image) image.Image {
+				bg := image.NewNRGBA(image.Rect(0, 0, width, height))
+				return imaging.PasteCenter(bg, imaging.Resize(img, w, h, imaging.Linear))
+			}
+		default:
+			return width, height, cover(width, height)
+		}
+
+	case c.Height != 0:
+		w, h := inside(srcWidth, c.Height)
+		return w, h, scale(w, h)
+
+	case c.Width == 0:
+		// Only a region was asked for
+		return srcWidth, srcHeight, func(img image.Image) image.Image { return img }
+
+	case c.Crop:
+		side := int(math.Min(float64(srcWidth), float64(srcHeight)))
+		if c.Width < side {
+			side = c.Width
+		}
+		return side, side, cover(side, side)
+	}
+
+	w, h := inside(c.Width, srcHeight)
+	return w, h, scale(w, h)
+}
+
+// gifPalette is the palette every output frame is drawn with. Frames
+// are composited, so one can show colors from the palettes of earlier
+// frames as well as its own. Every frame's colors are pooled, starting
+// with the global color table, unless there are too many, in which
+// case the global table is used alone or, without one, the web-safe
+// colors.
+func gifPalette(g *gif.GIF) color.Palette {
+	global, _ := g.Config.ColorModel.(color.Palette)
+
+	pooled := color.Palette{}
+	seen := make(map[[4]uint32]bool)
+	pool := func(p color.Palette) {
+		for _, c := range p {
+			var key [4]uint32
+			key[0], key[1], key[2], key[3] = c.RGBA()
+			if !seen[key] {
+				seen[key] = true
+				pooled = append(pooled, c)
+			}
+		}
+	}
+
+	pool(global)
+	for _, frame := range g.Image {
+		pool(frame.Palette)
+	}
+
+	switch {
+	case len(pooled) <= 256:
+		return withTransparent(pooled)
+	case len(global) > 0:
+		return withTransparent(global)
+	}
+
+	return withTransparent(palette.WebSafe)
+}
+
+// withTransparent adds a transparent entry to a palette, if
+// there's room, so resized frames keep their transparent areas.
+func withTransparent(p color.Palette) color.Palette {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	if len(p) >= 256 {
+		return p
+	}
+
+	return append(append(color.Palette{}, p...), color.Transparent)
+}
+
+// gifFrames counts a GIF's frames without decoding them.
+func gifFrames(raw []byte) int {
+	frames := 0
+	gifBlocks(raw, func(block []byte) {
+		if block[0] == 0x2c {
+			frames++
+		}
+	})
+
+	return frames
+}
+
+// animatedGif reports whether raw is a GIF with more than one frame.
+func animatedGif(raw []byte) bool {
+	return gifFrames(raw) > 1
+}
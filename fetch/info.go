@@ -0,0 +1,178 @@
+package fetch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/vokal/vip/config"
+	"github.com/vokal/vip/store"
+
+	"github.com/disintegration/imaging"
+	"github.com/golang/groupcache"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// Info describes an original image. Width and height are as
+// displayed, after any EXIF orientation is applied.
+type Info struct {
+	Width         int               `json:"width"`
+	Height        int               `json:"height"`
+	Format        string            `json:"format"`
+	Size          int               `json:"size"`
+	Frames        int               `json:"frames"`
+	Orientation   int               `json:"orientation"`
+	DominantColor string            `json:"dominant_color"`
+	BlurHash      string            `json:"blurhash"`
+	LQIP          string            `json:"lqip"`
+	Exif          map[string]string `json:"exif,omitempty"`
+}
+
+// infoFields are the EXIF fields reported by ImageInfo. Location data
+// is never included.
+var infoFields = []exif.FieldName{
+	exif.Make,
+	exif.Model,
+	exif.DateTimeOriginal,
+	exif.ExposureTime,
+	exif.FNumber,
+	exif.ISOSpeedRatings,
+	exif.FocalLength,
+}
+
+func ImageInfo(storage store.ImageStore, gc groupcache.Context) (*Info, error) {
+	c, ok := gc.(*CacheContext)
+	if !ok {
+		return nil, errors.New("invalid context")
+	}
+
+	reader, err := c.ReadOriginal(storage)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	raw, err := readImage(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := CheckSize(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	release := Reserve(size)
+	defer release()
+
+	img, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+
+	info := &Info{
+		Format:      format,
+		Size:        len(raw),
+		Frames:      1,
+		Orientation: orientation(bytes.NewReader(raw)),
+	}
+
+	img = orient(img, info.Orientation)
+	info.Width = img.Bounds().Dx()
+	info.Height = img.Bounds().Dy()
+	info.DominantColor = dominantColor(img)
+
+	placeholder, err := NewPlaceholder(img)
+	if err != nil {
+		return nil, err
+	}
+	info.BlurHash, info.LQIP = placeholder.BlurHash, placeholder.LQIP
+
+	if format == "gif" {
+		info.Frames = gifFrames(raw)
+	}
+
+	// Only report what the bucket's policy would let through
+	b, ok := config.Lookup(c.Bucket)
+	if !ok {
+		b = &config.Bucket{}
+	}
+	if BucketMetadataPolicy(b) != MetadataStrip {
+		info.Exif = exifFields(raw)
+	}
+
+	return info, nil
+}
+
+func exifFields(raw []byte) map[string]string {
+	metadata, err := exif.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+
+	fields := make(map[string]string)
+	for _, name := range infoFields {
+		tag, err := metadata.Get(name)
+		if err != nil {
+			continue
+		}
+
+		if tag.Format() == tiff.StringVal {
+			if s, err := tag.StringVal(); err == nil {
+				fields[string(name)] = s
+			}
+		} else {
+			fields[string(name)] = tag.String()
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// dominantColor returns the most common color in an image as a hex
+// string. Colors are grouped coarsely from a thumbnail so gradients
+// and noise don't split the vote.
+func dominantColor(img image.Image) string {
+	thumb := imaging.Fit(img, 64, 64, imaging.Box)
+
+	type total struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*total)
+
+	var best *total
+	for y := thumb.Rect.Min.Y; y < thumb.Rect.Max.Y; y++ {
+		for x := thumb.Rect.Min.X; x < thumb.Rect.Max.X; x++ {
+			c := thumb.NRGBAAt(x, y)
+			if c.A < 128 {
+				continue
+			}
+
+			key := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			t := buckets[key]
+			if t == nil {
+				t = &total{}
+				buckets[key] = t
+			}
+			t.count++
+			t.r += int(c.R)
+			t.g += int(c.G)
+			t.b += int(c.B)
+
+			if best == nil || t.count > best.count {
+				best = t
+			}
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
@@ -0,0 +1,99 @@
+package fetch
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"image"
+	"sync"
+)
+
+var ErrTooLarge = errors.New("image is too large to process")
+
+var (
+	maxPixels = int64(getEnvInt("VIP_MAX_PIXELS", 100000000))
+
+	decodes = newSemaphore(int64(getEnvInt("VIP_DECODE_MEMORY", 1024)) << 20)
+)
+
+// CheckSize reads the dimensions an image declares without decoding
+// it, refusing images over the VIP_MAX_PIXELS budget. A small file
+// can claim enormous dimensions, so this has to come before decoding.
+func CheckSize(raw []byte) (image.Config, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return config, ErrUnsupportedFormat
+	}
+
+	if int64(config.Width)*int64(config.Height) > maxPixels {
+		return config, ErrTooLarge
+	}
+
+	return config, nil
+}
+
+// Reserve waits until there's memory to decode an image of the given
+// size, so a burst of large images can't exhaust it between them. The
+// returned function gives the memory back.
+func Reserve(config image.Config) func() {
+	// Four bytes a pixel, the size of a decoded RGBA image
+	n := decodes.Acquire(int64(config.Width) * int64(config.Height) * 4)
+	return func() { decodes.Release(n) }
+}
+
+// semaphore is a weighted semaphore. Waiters are served in order, so
+// a large image isn't starved by a steady stream of small ones.
+type semaphore struct {
+	sync.Mutex
+	size, used int64
+	waiters    list.List
+}
+
+type waiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func newSemaphore(size int64) *semaphore {
+	return &semaphore{size: size}
+}
+
+// Acquire blocks until n is available and returns the amount held,
+// which is capped at the semaphore's size so any single image can
+// still be processed on its own.
+func (s *semaphore) Acquire(n int64) int64 {
+	if n > s.size {
+		n = s.size
+	}
+
+	s.Lock()
+	if s.size-s.used >= n && s.waiters.Len() == 0 {
+		s.used += n
+		s.Unlock()
+		return n
+	}
+
+	w := waiter{n, make(chan struct{})}
+	s.waiters.PushBack(w)
+	s.Unlock()
+
+	<-w.ready
+	return n
+}
+
+func (s *semaphore) Release(n int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.used -= n
+	for e := s.waiters.Front(); e != nil; e = s.waiters.Front() {
+		w := e.Value.(waiter)
+		if s.size-s.used < w.n {
+			break
+		}
+
+		s.used += w.n
+		s.waiters.Remove(e)
+		close(w.ready)
+	}
+}
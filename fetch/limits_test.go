@@ -0,0 +1,95 @@
+package fetch
+
+import (
+	"bytes"
+	"image/gif"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/vokal/vip/test"
+)
+
+func TestCheckSize(t *testing.T) {
+	if _, err := CheckSize(test.BombPNG(50000, 50000)); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge; got %v", err)
+	}
+
+	size, err := CheckSize(test.BombPNG(8000, 6000))
+	if err != nil || size.Width != 8000 || size.Height != 6000 {
+		t.Errorf("Expected 8000x6000; got %dx%d (%v)", size.Width, size.Height, err)
+	}
+
+	if _, err := CheckSize([]byte("not an image")); err != ErrUnsupportedFormat {
+		t.Errorf("Expected ErrUnsupportedFormat; got %v", err)
+	}
+}
+
+func TestDecodeBomb(t *testing.T) {
+	bomb := test.BombPNG(50000, 50000)
+
+	if _, err := Resize(bytes.NewReader(bomb), &CacheContext{Width: 100}); err != ErrTooLarge {
+		t.Errorf("Resize: expected ErrTooLarge; got %v", err)
+	}
+	if _, _, err := GetRotatedImage(bytes.NewReader(bomb)); err != ErrTooLarge {
+		t.Errorf("GetRotatedImage: expected ErrTooLarge; got %v", err)
+	}
+	if _, err := Convert(bytes.NewReader(bomb), FormatJPEG, 80); err != ErrTooLarge {
+		t.Errorf("Convert: expected ErrTooLarge; got %v", err)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	s := newSemaphore(10)
+
+	if n := s.Acquire(6); n != 6 {
+		t.Fatalf("Expected 6; got %d", n)
+	}
+
+	order := make(chan int64, 2)
+	for _, n := range []int64{20, 2} {
+		go func(n int64) {
+			order <- s.Acquire(n)
+		}(n)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// There's room for 2, but it waits behind the larger request
+	select {
+	case n := <-order:
+		t.Fatalf("Expected both to wait; %d didn't", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Requests over the size are capped so they can run alone
+	s.Release(6)
+	if n := <-order; n != 10 {
+		t.Errorf("Expected the capped request first; got %d", n)
+	}
+
+	s.Release(10)
+	if n := <-order; n != 2 {
+		t.Errorf("Expected 2; got %d", n)
+	}
+}
+
+func TestGifFrames(t *testing.T) {
+	for filename, expected := range map[string]int{"animated.gif": 2, "static.gif": 1} {
+		raw, err := ioutil.ReadFile("../test/" + filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frames := gifFrames(raw); frames != expected {
+			t.Errorf("%s: expected %d frames; got %d", filename, expected, frames)
+		}
+
+		g, err := gif.DecodeAll(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(g.Image) != expected {
+			t.Errorf("%s: decoded %d frames", filename, len(g.Image))
+		}
+	}
+}
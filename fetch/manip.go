@@ -2,40 +2,62 @@ package fetch
 
 import (
 	"bytes"
-	"errors"
 	"image"
+	"image/draw"
+	"image/jpeg"
 	"image/png"
 	"io"
 	"io/ioutil"
 	"math"
+	"net/http"
 
 	"github.com/daddye/vips"
 	"github.com/disintegration/imaging"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
-func needsRotation(src io.Reader) int {
+// orientation reads an image's EXIF orientation, 1 through 8. Images
+// without one are taken to be stored upright.
+func orientation(src io.Reader) int {
 	metadata, err := exif.Decode(src)
 	if err != nil {
-		return 0
+		return 1
 	}
 
-	orientation, err := metadata.Get(exif.Orientation)
+	tag, err := metadata.Get(exif.Orientation)
 	if err != nil {
-		return 0
+		return 1
 	}
 
-	switch orientation.String() {
-	case "6":
-		return 270
-	case "3":
-		return 180
-	case "8":
-		return 90
-	default:
-		return 0
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
 	}
 
+	return o
+}
+
+// orient transforms an image stored with the given EXIF orientation
+// so it displays upright. Orientations 2, 4, 5 and 7 are mirrored.
+func orient(img image.Image, o int) image.Image {
+	switch o {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+
+	return img
 }
 
 func GetRotatedImage(src io.Reader) (image.Image, string, error) {
@@ -44,28 +66,63 @@ func GetRotatedImage(src io.Reader) (image.Image, string, error) {
 		return nil, "", err
 	}
 
-	data := bytes.NewReader(raw)
+	if _, err := CheckSize(raw); err != nil {
+		return nil, "", err
+	}
 
-	image, format, err := image.Decode(data)
+	image, format, err := image.Decode(bytes.NewReader(raw))
 	if err != nil {
 		return nil, "", err
 	}
 
-	if _, err := data.Seek(0, 0); err != nil {
-		return nil, "", err
+	return orient(image, orientation(bytes.NewReader(raw))), format, nil
+}
+
+// AutoOrient bakes an image's EXIF orientation into its pixels, since
+// vips and Go's decoders use them as stored. Upright images are
+// returned untouched; others are re-encoded as JPEG, keeping their
+// metadata, or, to keep any transparency, PNG.
+func AutoOrient(raw []byte) ([]byte, error) {
+	o := orientation(bytes.NewReader(raw))
+	if o == 1 {
+		return raw, nil
 	}
 
-	angle := needsRotation(data)
-	switch angle {
-	case 90:
-		image = imaging.Rotate90(image)
-	case 180:
-		image = imaging.Rotate180(image)
-	case 270:
-		image = imaging.Rotate270(image)
+	if _, err := CheckSize(raw); err != nil {
+		return nil, err
 	}
 
-	return image, format, nil
+	img, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if format != "jpeg" {
+		if err := png.Encode(buf, orient(img, o)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	if err := jpeg.Encode(buf, orient(img, o), &jpeg.Options{Quality: 100}); err != nil {
+		return nil, err
+	}
+
+	// Metadata policies are applied separately, so keep it all for now
+	return copyJPEGMetadata(raw, buf.Bytes())
+}
+
+// UprightSize is the width and height of an image as displayed, from
+// the header CheckSize read and its EXIF orientation, so it's known
+// without decoding the image.
+func UprightSize(raw []byte, config image.Config) (int, int) {
+	// Orientations 5 to 8 turn the image on its side
+	if orientation(bytes.NewReader(raw)) >= 5 {
+		return config.Height, config.Width
+	}
+
+	return config.Width, config.Height
 }
 
 func Resize(src io.Reader, c *CacheContext) (io.Reader, error) {
@@ -74,16 +131,84 @@ func Resize(src io.Reader, c *CacheContext) (io.Reader, error) {
 		return nil, err
 	}
 
+	if _, err := CheckSize(raw); err != nil {
+		return nil, err
+	}
+
+	raw, err = AutoOrient(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// The region is taken from the upright original, at full quality
+	// if it's going to be resized
+	if c.Rect != nil {
+		if c.Width == 0 && c.Height == 0 {
+			raw, err = extract(raw, c.Rect, c.quality())
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(raw), nil
+		}
+
+		raw, err = extract(raw, c.Rect, 100)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	options := vips.Options{
 		Width:        c.Width,
 		Crop:         true,
 		Extend:       vips.EXTEND_WHITE,
 		Interpolator: vips.BILINEAR,
 		Gravity:      vips.CENTRE,
-		Quality:      80,
+		Quality:      c.quality(),
 	}
+	if g, ok := vipsGravity[c.Gravity]; ok {
+		options.Gravity = g
+	}
+
+	switch {
+	case c.Width != 0 && c.Height != 0:
+		config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+
+		width, height := shrinkBox(c.Width, c.Height, config.Width, config.Height)
 
-	if c.Crop {
+		switch c.Fit {
+		case FitFill:
+			return fill(raw, width, height, options.Quality)
+		case FitInside:
+			scale := math.Min(float64(c.Width)/float64(config.Width),
+				float64(c.Height)/float64(config.Height))
+			if scale < 1 {
+				options.Width = int(math.Floor(float64(config.Width) * scale))
+			} else {
+				options.Width = config.Width
+			}
+		case FitContain:
+			options.Width = width
+			options.Height = height
+			options.Crop = false
+		default:
+			options.Width = width
+			options.Height = height
+		}
+
+	case c.Height != 0:
+		config, _, err := image.DecodeConfig(bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+
+		// vips scales height-only requests against the width, so
+		// convert to the equivalent width here
+		options.Width = int(math.Floor(float64(config.Width) * float64(c.Height) / float64(config.Height)))
+
+	case c.Crop:
 		data := bytes.NewReader(raw)
 
 		image, _, err := image.Decode(data)
@@ -100,6 +225,10 @@ func Resize(src io.Reader, c *CacheContext) (io.Reader, error) {
 		options.Height = options.Width
 	}
 
+	if _, ok := c.focus(); ok && c.Crops() {
+		return focusCrop(raw, options.Width, options.Height, options.Quality, c)
+	}
+
 	res, err := vips.Resize(raw, options)
 	if err != nil {
 		return nil, err
@@ -108,19 +237,103 @@ func Resize(src io.Reader, c *CacheContext) (io.Reader, error) {
 	return bytes.NewBuffer(res), err
 }
 
-func ResizeGif(src io.Reader, c *CacheContext) (io.Reader, error) {
-	raw, format, err := image.Decode(src)
+// shrinkBox scales a width x height box down, keeping its aspect
+// ratio, until it fits within the source image. vips refuses to
+// enlarge, so a box bigger than the source would otherwise be ignored.
+func shrinkBox(width, height, srcWidth, srcHeight int) (int, int) {
+	scale := math.Min(float64(srcWidth)/float64(width), float64(srcHeight)/float64(height))
+	if scale >= 1 {
+		return width, height
+	}
+
+	width = int(math.Max(1, math.Floor(float64(width)*scale)))
+	height = int(math.Max(1, math.Floor(float64(height)*scale)))
+
+	return width, height
+}
+
+// fill stretches an image to exactly width x height, keeping PNGs as
+// PNGs so their transparency survives.
+func fill(raw []byte, width, height, quality int) (io.Reader, error) {
+	img, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	resized := imaging.Resize(img, width, height, imaging.Linear)
+
+	buf := new(bytes.Buffer)
+	if format == "png" {
+		err = png.Encode(buf, resized)
+	} else {
+		err = jpeg.Encode(buf, resized, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func Convert(src io.Reader, format Format, quality int) (io.Reader, error) {
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	content := http.DetectContentType(raw)
+	if content == format.ContentType() {
+		return bytes.NewReader(raw), nil
+	}
+
+	if _, err := CheckSize(raw); err != nil {
+		return nil, err
+	}
+
+	raw, err = AutoOrient(raw)
 	if err != nil {
 		return nil, err
 	}
-	if format != "gif" {
-		return nil, errors.New("Aborted attempt to resize another type as a gif")
+
+	// libvips only needs to handle what vips.Resize can produce
+	if format == FormatWebP && (content == "image/jpeg" || content == "image/png") {
+		res, err := encodeWebP(raw, content == "image/png", quality)
+		if err != nil {
+			return nil, err
+		}
+
+		return bytes.NewReader(res), nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
 	}
 
-	pngBuf := new(bytes.Buffer)
-	if png.Encode(pngBuf, raw) != nil {
+	buf := new(bytes.Buffer)
+	switch format {
+	case FormatPNG:
+		err = png.Encode(buf, img)
+	case FormatWebP:
+		// Hand anything else to libvips as a lossless PNG
+		if err = png.Encode(buf, img); err == nil {
+			return Convert(buf, format, quality)
+		}
+	default:
+		err = jpeg.Encode(buf, flatten(img), &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	return Resize(pngBuf, c)
+	return buf, nil
+}
+
+// flatten composites an image onto white, matching the background
+// vips uses, since JPEG has no alpha channel.
+func flatten(img image.Image) image.Image {
+	bg := image.NewRGBA(img.Bounds())
+	draw.Draw(bg, bg.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(bg, bg.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	return bg
 }
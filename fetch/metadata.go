@@ -0,0 +1,543 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/vokal/vip/config"
+)
+
+// MetadataPolicy controls what metadata is kept in stored and served
+// images.
+type MetadataPolicy string
+
+const (
+	// Remove everything but what's needed to display the image, like
+	// color profiles
+	MetadataStrip MetadataPolicy = "strip"
+
+	// Remove location data and keep the rest
+	MetadataGPS MetadataPolicy = "gps"
+
+	// Leave metadata as uploaded
+	MetadataKeep MetadataPolicy = "keep"
+)
+
+var (
+	defaultMetadata = getMetadataPolicy()
+
+	errBadMetadata = errors.New("malformed image metadata")
+
+	// Verbose logs the metadata fields removed from each image
+	Verbose bool
+)
+
+func ParseMetadataPolicy(s string) (MetadataPolicy, bool) {
+	switch p := MetadataPolicy(strings.ToLower(s)); p {
+	case MetadataStrip, MetadataGPS, MetadataKeep:
+		return p, true
+	}
+
+	return "", false
+}
+
+func getMetadataPolicy() MetadataPolicy {
+	if p, ok := ParseMetadataPolicy(os.Getenv("VIP_METADATA")); ok {
+		return p
+	}
+
+	return MetadataStrip
+}
+
+// BucketMetadataPolicy returns the metadata policy for a bucket,
+// falling back to VIP_METADATA.
+func BucketMetadataPolicy(b *config.Bucket) MetadataPolicy {
+	if p, ok := ParseMetadataPolicy(b.Metadata); ok {
+		return p
+	}
+
+	return defaultMetadata
+}
+
+// stripMetadata applies the bucket's metadata policy to an image being
+// served, which also covers originals stored before the policy was set.
+// Metadata it can't make sense of is left alone rather than failing
+// the request.
+func (c *CacheContext) stripMetadata(data []byte) ([]byte, error) {
+	b, ok := config.Lookup(c.Bucket)
+	if !ok {
+		b = &config.Bucket{}
+	}
+
+	stripped, removed, err := StripMetadata(data, BucketMetadataPolicy(b))
+	if err != nil {
+		// The image itself can still be fine, so it's served as it is
+		log.Printf("Metadata of %s/%s left in place: %s", c.Bucket, c.CacheKey(), err.Error())
+		return data, nil
+	}
+	if Verbose && len(removed) > 0 {
+		log.Printf("Removed metadata from %s/%s: %s", c.Bucket, c.CacheKey(), strings.Join(removed, ", "))
+	}
+
+	return stripped, nil
+}
+
+// StripMetadata removes metadata from a JPEG, PNG or GIF according to
+// the policy, and describes each field it removed. Image data is left
+// as is, so nothing is re-encoded.
+func StripMetadata(raw []byte, policy MetadataPolicy) ([]byte, []string, error) {
+	if policy == MetadataKeep {
+		return raw, nil, nil
+	}
+
+	switch http.DetectContentType(raw) {
+	case "image/jpeg":
+		return stripJPEG(raw, policy)
+	case "image/png":
+		return stripPNG(raw, policy)
+	case "image/gif":
+		return stripGIF(raw)
+	}
+
+	return raw, nil, nil
+}
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+	mpfHeader  = []byte("MPF\x00")
+)
+
+func stripJPEG(raw []byte, policy MetadataPolicy) ([]byte, []string, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(raw)))
+	out.Write(raw[:2])
+
+	var removed []string
+	for i := 2; ; {
+		if i+1 >= len(raw) || raw[i] != 0xff {
+			return nil, nil, errBadMetadata
+		}
+
+		marker := raw[i+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte
+			i++
+			continue
+		case marker == 0xd9:
+			// Anything after the end of the image, like the previews
+			// some cameras append, goes too
+			out.Write(raw[i : i+2])
+			if i+2 < len(raw) {
+				removed = append(removed, "trailing data")
+			}
+			return out.Bytes(), removed, nil
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			out.Write(raw[i : i+2])
+			i += 2
+			continue
+		}
+
+		if i+4 > len(raw) {
+			return nil, nil, errBadMetadata
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(raw[i+2:]))
+		if end > len(raw) || end < i+4 {
+			return nil, nil, errBadMetadata
+		}
+		segment, data := raw[i:end], raw[i+4:end]
+
+		keep := true
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(data, exifHeader):
+			if policy == MetadataGPS {
+				scrubbed := append([]byte{}, segment...)
+				gps, err := scrubGPS(scrubbed[4+len(exifHeader):])
+				if err != nil {
+					return nil, nil, err
+				}
+				segment = scrubbed
+				removed = append(removed, gps...)
+			} else {
+				keep = false
+				removed = append(removed, "EXIF")
+			}
+		case marker == 0xe1 && bytes.HasPrefix(data, xmpHeader):
+			// XMP often repeats the EXIF location, so it goes either way
+			keep = false
+			removed = append(removed, "XMP")
+		case marker == 0xe2 && bytes.HasPrefix(data, iccHeader), marker == 0xe0, marker == 0xee:
+			// Color profiles, JFIF and Adobe segments affect display
+		case marker == 0xe2 && bytes.HasPrefix(data, mpfHeader):
+			// Indexes the trailing previews, which are always removed
+			keep = false
+			removed = append(removed, "MPF")
+		case marker == 0xed:
+			keep = policy == MetadataGPS
+			if !keep {
+				removed = append(removed, "IPTC")
+			}
+		case marker == 0xfe:
+			keep = policy == MetadataGPS
+			if !keep {
+				removed = append(removed, "comment")
+			}
+		case marker >= 0xe1 && marker <= 0xef:
+			keep = policy == MetadataGPS
+			if !keep {
+				removed = append(removed, fmt.Sprintf("APP%d", marker-0xe0))
+			}
+		}
+
+		if keep {
+			out.Write(segment)
+		}
+		i = end
+
+		if marker == 0xda {
+			// Copy the entropy-coded scan up to the next marker
+			for ; i+1 < len(raw); i++ {
+				if raw[i] == 0xff && raw[i+1] != 0 && raw[i+1] != 0xff && (raw[i+1] < 0xd0 || raw[i+1] > 0xd7) {
+					break
+				}
+				out.WriteByte(raw[i])
+			}
+			if i+1 >= len(raw) {
+				// Truncated; keep what's there
+				out.Write(raw[i:])
+				return out.Bytes(), removed, nil
+			}
+		}
+	}
+}
+
+// copyJPEGMetadata carries the metadata segments of the JPEG src over
+// to dst, a re-encoding of it. dst has already been rotated, so the
+// EXIF orientation is reset to upright.
+func copyJPEGMetadata(src, dst []byte) ([]byte, error) {
+	if len(dst) < 2 {
+		return nil, errBadMetadata
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(dst)))
+	out.Write(dst[:2])
+
+	for i := 2; i+4 <= len(src) && src[i] == 0xff; {
+		marker := src[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+
+		end := i + 2 + int(binary.BigEndian.Uint16(src[i+2:]))
+		if end > len(src) || end < i+4 {
+			return nil, errBadMetadata
+		}
+		segment, data := src[i:end], src[i+4:end]
+		i = end
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(data, exifHeader):
+			segment = append([]byte{}, segment...)
+			if err := resetOrientation(segment[4+len(exifHeader):]); err != nil {
+				return nil, err
+			}
+		case marker == 0xe2 && bytes.HasPrefix(data, mpfHeader), marker == 0xee:
+			// Previews are dropped, and the Adobe segment describes
+			// the old encoding
+			continue
+		case marker < 0xe1 || marker > 0xef && marker != 0xfe:
+			continue
+		}
+
+		out.Write(segment)
+	}
+
+	out.Write(dst[2:])
+	return out.Bytes(), nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+func stripPNG(raw []byte, policy MetadataPolicy) ([]byte, []string, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(raw)))
+	out.Write(pngSignature)
+
+	var removed []string
+	for i := len(pngSignature); i < len(raw); {
+		if i+8 > len(raw) {
+			return nil, nil, errBadMetadata
+		}
+		length := int(binary.BigEndian.Uint32(raw[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(raw) {
+			return nil, nil, errBadMetadata
+		}
+		chunk := raw[i:end]
+		kind, data := string(chunk[4:8]), chunk[8:8+length]
+
+		keep := true
+		switch kind {
+		case "eXIf":
+			if policy == MetadataGPS {
+				scrubbed := append([]byte{}, chunk...)
+				gps, err := scrubGPS(scrubbed[8 : 8+length])
+				if err != nil {
+					return nil, nil, err
+				}
+				binary.BigEndian.PutUint32(scrubbed[8+length:], crc32.ChecksumIEEE(scrubbed[4:8+length]))
+				chunk = scrubbed
+				removed = append(removed, gps...)
+			} else {
+				keep = false
+				removed = append(removed, "EXIF")
+			}
+		case "tEXt", "zTXt", "iTXt":
+			keyword := string(data)
+			if n := bytes.IndexByte(data, 0); n >= 0 {
+				keyword = string(data[:n])
+			}
+
+			// Embedded XMP and EXIF profiles can carry a location
+			keep = policy == MetadataGPS && keyword != "XML:com.adobe.xmp" &&
+				!strings.HasPrefix(keyword, "Raw profile type")
+			if !keep {
+				removed = append(removed, fmt.Sprintf("%s %q", kind, keyword))
+			}
+		case "tIME":
+			keep = policy == MetadataGPS
+			if !keep {
+				removed = append(removed, kind)
+			}
+		}
+
+		if keep {
+			out.Write(chunk)
+		}
+		i = end
+	}
+
+	return out.Bytes(), removed, nil
+}
+
+// gifBlocks calls fn with each image and extension block of a GIF,
+// returning the length of the header, screen descriptor and global
+// color table before them, and whether the trailer was reached.
+func gifBlocks(raw []byte, fn func(block []byte)) (int, bool, error) {
+	if len(raw) < 13 {
+		return 0, false, errBadMetadata
+	}
+
+	// Header, screen descriptor and global color table
+	header := 13
+	if raw[10]&0x80 != 0 {
+		header += 3 << (uint(raw[10]&0x07) + 1)
+	}
+	if header > len(raw) {
+		return 0, false, errBadMetadata
+	}
+
+	// subBlocks returns the end of the data sub-blocks starting at i
+	subBlocks := func(i int) (int, error) {
+		for i < len(raw) {
+			if raw[i] == 0 {
+				return i + 1, nil
+			}
+			i += int(raw[i]) + 1
+		}
+		return 0, errBadMetadata
+	}
+
+	for i := header; i < len(raw); {
+		var end int
+		var err error
+
+		switch raw[i] {
+		case 0x3b:
+			return header, true, nil
+
+		case 0x2c:
+			// Image descriptor, local color table and image data
+			if i+11 > len(raw) {
+				return 0, false, errBadMetadata
+			}
+			data := i + 10
+			if raw[data-1]&0x80 != 0 {
+				data += 3 << (uint(raw[data-1]&0x07) + 1)
+			}
+			end, err = subBlocks(data + 1)
+
+		case 0x21:
+			if i+2 > len(raw) {
+				return 0, false, errBadMetadata
+			}
+			end, err = subBlocks(i + 2)
+
+		default:
+			return 0, false, errBadMetadata
+		}
+		if err != nil {
+			return 0, false, err
+		}
+
+		fn(raw[i:end])
+		i = end
+	}
+
+	// No trailer; keep what's there
+	return header, false, nil
+}
+
+// stripGIF removes comments and application extensions other than
+// animation loops. GIFs have no location fields of their own, so
+// they're treated the same under either policy.
+func stripGIF(raw []byte) ([]byte, []string, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(raw)))
+
+	var removed []string
+	header, trailer, err := gifBlocks(raw, func(block []byte) {
+		if block[0] == 0x21 {
+			switch block[1] {
+			case 0xfe:
+				removed = append(removed, "comment")
+				return
+			case 0xff:
+				var app string
+				if len(block) >= 14 && block[2] == 11 {
+					app = string(block[3:14])
+				}
+				if app != "NETSCAPE2.0" && app != "ANIMEXTS1.0" && app != "ICCRGBG1012" {
+					removed = append(removed, fmt.Sprintf("application extension %q", app))
+					return
+				}
+			}
+		}
+		out.Write(block)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := append(append([]byte{}, raw[:header]...), out.Bytes()...)
+	if trailer {
+		result = append(result, 0x3b)
+	}
+
+	return result, removed, nil
+}
+
+var gpsTags = map[uint16]string{
+	0x00: "GPSVersionID",
+	0x01: "GPSLatitudeRef",
+	0x02: "GPSLatitude",
+	0x03: "GPSLongitudeRef",
+	0x04: "GPSLongitude",
+	0x05: "GPSAltitudeRef",
+	0x06: "GPSAltitude",
+	0x07: "GPSTimeStamp",
+	0x10: "GPSImgDirectionRef",
+	0x11: "GPSImgDirection",
+	0x12: "GPSMapDatum",
+	0x1d: "GPSDateStamp",
+}
+
+// Sizes of the TIFF field types, in bytes
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// tiffIFD returns the byte order of a TIFF header along with a function
+// that finds an IFD entry by tag, returning its offset.
+func tiffIFD(tiff []byte) (binary.ByteOrder, func(ifd int, tag uint16) (int, bool), error) {
+	var order binary.ByteOrder
+	switch {
+	case len(tiff) < 8:
+		return nil, nil, errBadMetadata
+	case tiff[0] == 'I' && tiff[1] == 'I':
+		order = binary.LittleEndian
+	case tiff[0] == 'M' && tiff[1] == 'M':
+		order = binary.BigEndian
+	default:
+		return nil, nil, errBadMetadata
+	}
+
+	find := func(ifd int, tag uint16) (int, bool) {
+		if ifd+2 > len(tiff) {
+			return 0, false
+		}
+		for n, e := int(order.Uint16(tiff[ifd:])), ifd+2; n > 0 && e+12 <= len(tiff); n, e = n-1, e+12 {
+			if order.Uint16(tiff[e:]) == tag {
+				return e, true
+			}
+		}
+		return 0, false
+	}
+
+	return order, find, nil
+}
+
+// scrubGPS blanks the GPS IFD of the EXIF data in tiff, in place, and
+// names the tags removed.
+func scrubGPS(tiff []byte) ([]string, error) {
+	order, find, err := tiffIFD(tiff)
+	if err != nil {
+		return nil, err
+	}
+
+	pointer, ok := find(int(order.Uint32(tiff[4:])), 0x8825)
+	if !ok {
+		return nil, nil
+	}
+	ifd := int(order.Uint32(tiff[pointer+8:]))
+	if ifd+2 > len(tiff) {
+		return nil, errBadMetadata
+	}
+
+	var removed []string
+	for n, e := int(order.Uint16(tiff[ifd:])), ifd+2; n > 0 && e+12 <= len(tiff); n, e = n-1, e+12 {
+		tag := order.Uint16(tiff[e:])
+		size := tiffTypeSizes[order.Uint16(tiff[e+2:])] * int(order.Uint32(tiff[e+4:]))
+
+		// Values over four bytes live elsewhere and are wiped too
+		if offset := int(order.Uint32(tiff[e+8:])); size > 4 && offset >= 0 && offset+size <= len(tiff) {
+			zero(tiff[offset : offset+size])
+		}
+		zero(tiff[e : e+12])
+
+		if name, ok := gpsTags[tag]; ok {
+			removed = append(removed, name)
+		} else {
+			removed = append(removed, fmt.Sprintf("GPS tag 0x%02x", tag))
+		}
+	}
+	order.PutUint16(tiff[ifd:], 0)
+
+	return removed, nil
+}
+
+// resetOrientation marks the EXIF data in tiff, in place, as upright.
+func resetOrientation(tiff []byte) error {
+	order, find, err := tiffIFD(tiff)
+	if err != nil {
+		return err
+	}
+
+	if e, ok := find(int(order.Uint32(tiff[4:])), 0x0112); ok && order.Uint16(tiff[e+2:]) == 3 {
+		order.PutUint16(tiff[e+8:], 1)
+	}
+
+	return nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,213 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/gif"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// exifSegment builds an APP1 segment holding a camera make, an
+// orientation and a GPS latitude.
+func exifSegment(orientation uint16) []byte {
+	tiff := new(bytes.Buffer)
+	w := func(v interface{}) { binary.Write(tiff, binary.BigEndian, v) }
+
+	// Header; IFD0 at 8 ends at 50, the make string at 56, and the
+	// GPS IFD at 86
+	tiff.WriteString("MM")
+	w(uint16(42))
+	w(uint32(8))
+
+	w(uint16(3))
+	w([]uint16{0x010f, 2}) // Make
+	w([]uint32{6, 50})
+	w([]uint16{0x0112, 3, 0, 1}) // Orientation
+	w([]uint16{orientation, 0})
+	w([]uint16{0x8825, 4}) // GPS IFD
+	w([]uint32{1, 56})
+	w(uint32(0))
+	tiff.WriteString("Canon\x00")
+
+	w(uint16(2))
+	w([]uint16{0x0001, 2, 0, 2}) // GPSLatitudeRef
+	tiff.WriteString("N\x00\x00\x00")
+	w([]uint16{0x0002, 5}) // GPSLatitude
+	w([]uint32{3, 86})
+	w(uint32(0))
+	w([]uint32{37, 1, 46, 1, 30, 1})
+
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(exifHeader)+tiff.Len()))
+	segment = append(segment, exifHeader...)
+	return append(segment, tiff.Bytes()...)
+}
+
+// withExif replaces a JPEG's metadata with an EXIF segment.
+func withExif(t *testing.T, filename string, orientation uint16) []byte {
+	raw := stripped(t, filename)
+
+	return append(append(append([]byte{}, raw[:2]...), exifSegment(orientation)...), raw[2:]...)
+}
+
+// stripped reads a test image with all its metadata removed.
+func stripped(t *testing.T, filename string) []byte {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _, err = StripMetadata(raw, MetadataStrip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func TestStripMetadataJPEG(t *testing.T) {
+	raw := withExif(t, "../test/awesome-small.jpg", 1)
+
+	kept, removed, err := StripMetadata(raw, MetadataKeep)
+	if err != nil || !bytes.Equal(kept, raw) || removed != nil {
+		t.Errorf("Expected keep to leave the image alone; removed %v (%v)", removed, err)
+	}
+
+	clean, removed, err := StripMetadata(raw, MetadataStrip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"EXIF"}) {
+		t.Errorf("Unexpected fields removed: %v", removed)
+	}
+	if _, err := exif.Decode(bytes.NewReader(clean)); err == nil {
+		t.Error("Expected no EXIF data after stripping")
+	}
+	if len(clean) != len(raw)-len(exifSegment(1)) {
+		t.Errorf("Expected only the EXIF segment to be removed")
+	}
+
+	scrubbed, removed, err := StripMetadata(raw, MetadataGPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"GPSLatitudeRef", "GPSLatitude"}) {
+		t.Errorf("Unexpected fields removed: %v", removed)
+	}
+
+	metadata, err := exif.Decode(bytes.NewReader(scrubbed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if camera, err := metadata.Get(exif.Make); err != nil || camera.String() != `"Canon"` {
+		t.Errorf("Expected the camera make to be kept; got %v (%v)", camera, err)
+	}
+	if _, err := metadata.Get(exif.GPSLatitude); err == nil {
+		t.Error("Expected the latitude to be removed")
+	}
+
+	// The values themselves are wiped, not just unlinked
+	latitude := []byte{0, 0, 0, 37, 0, 0, 0, 1, 0, 0, 0, 46}
+	if !bytes.Contains(raw, latitude) || bytes.Contains(scrubbed, latitude) {
+		t.Error("Expected the latitude bytes to be wiped")
+	}
+}
+
+func TestAutoOrientKeepsMetadata(t *testing.T) {
+	raw := withExif(t, "../test/f1-exif.jpg", 6)
+
+	oriented, err := AutoOrient(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := exif.Decode(bytes.NewReader(oriented))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := metadata.Get(exif.Make); err != nil {
+		t.Error("Expected the camera make to be kept")
+	}
+	if o := orientation(bytes.NewReader(oriented)); o != 1 {
+		t.Errorf("Expected the orientation to be reset to 1; got %d", o)
+	}
+}
+
+func TestStripMetadataPNG(t *testing.T) {
+	raw, err := ioutil.ReadFile("../test/test_inspiration.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []MetadataPolicy{MetadataStrip, MetadataGPS} {
+		clean, removed, err := StripMetadata(raw, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(removed, []string{`iTXt "XML:com.adobe.xmp"`}) {
+			t.Errorf("%s: unexpected fields removed: %v", policy, removed)
+		}
+		if !bytes.Contains(clean, []byte("iCCP")) {
+			t.Errorf("%s: expected the color profile to be kept", policy)
+		}
+	}
+}
+
+func TestStripMetadataGIF(t *testing.T) {
+	raw := stripped(t, "../test/animated.gif")
+
+	// Add a comment before the first block
+	start := 13
+	if raw[10]&0x80 != 0 {
+		start += 3 << (uint(raw[10]&0x07) + 1)
+	}
+	comment := []byte{0x21, 0xfe, 5, 'h', 'e', 'l', 'l', 'o', 0}
+	commented := append(append(append([]byte{}, raw[:start]...), comment...), raw[start:]...)
+
+	uncommented, removed, err := StripMetadata(commented, MetadataStrip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"comment"}) {
+		t.Errorf("Unexpected fields removed: %v", removed)
+	}
+	if !bytes.Equal(uncommented, raw) {
+		t.Error("Expected only the comment to be removed")
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(uncommented))
+	if err != nil || len(g.Image) != 2 {
+		t.Errorf("Expected both frames to survive (%v)", err)
+	}
+}
+
+func TestStripMetadataTruncated(t *testing.T) {
+	raw := stripped(t, "../test/awesome-small.jpg")
+
+	// The APP1 segment ends partway through the TIFF header
+	segment := append([]byte{0xff, 0xe1, 0, 12}, exifHeader...)
+	segment = append(segment, "MM\x00\x2a"...)
+	truncated := append(append(append([]byte{}, raw[:2]...), segment...), raw[2:]...)
+
+	if _, _, err := StripMetadata(truncated, MetadataGPS); err != errBadMetadata {
+		t.Fatalf("Expected errBadMetadata; got %v", err)
+	}
+
+	// Served as it is, since the image itself is fine
+	policy := defaultMetadata
+	defer func() { defaultMetadata = policy }()
+	defaultMetadata = MetadataGPS
+
+	c := &CacheContext{ImageId: "abc", Bucket: "nobucket"}
+	served, err := c.stripMetadata(truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(served, truncated) {
+		t.Error("Expected the image to be served unchanged")
+	}
+}
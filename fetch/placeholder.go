@@ -0,0 +1,151 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Placeholder holds stand-ins to show while an image loads: a BlurHash
+// (https://blurha.sh) and a tiny JPEG preview as a data URI.
+type Placeholder struct {
+	BlurHash string `json:"blurhash"`
+	LQIP     string `json:"lqip"`
+}
+
+const lqipSize = 16
+
+// thumbSize is the longest side of the thumbnail both placeholders are
+// made from. Shrinking before flattening keeps the work, and memory,
+// the same whatever the size of the image.
+const thumbSize = 32
+
+func NewPlaceholder(img image.Image) (*Placeholder, error) {
+	thumb := flatten(imaging.Fit(img, thumbSize, thumbSize, imaging.Box))
+	preview := imaging.Fit(thumb, lqipSize, lqipSize, imaging.Linear)
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, preview, &jpeg.Options{Quality: 40}); err != nil {
+		return nil, err
+	}
+
+	return &Placeholder{
+		BlurHash: blurHash(thumb),
+		LQIP:     "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func base83(value, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Chars[value%83]
+		value /= 83
+	}
+
+	return string(b)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// blurHash encodes an opaque image with four components along its long
+// side and three along the short one. The hash only holds a few cosine
+// components, so it's computed from a small thumbnail.
+func blurHash(img image.Image) string {
+	thumb := imaging.Fit(img, thumbSize, thumbSize, imaging.Box)
+	width, height := thumb.Rect.Dx(), thumb.Rect.Dy()
+
+	cx, cy := 4, 3
+	if height > width {
+		cx, cy = 3, 4
+	}
+
+	// Linear colors, so each component is a weighted average
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := thumb.NRGBAAt(thumb.Rect.Min.X+x, thumb.Rect.Min.Y+y)
+			linear[y*width+x] = [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var f [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					for k := range f {
+						f[k] += basis * linear[y*width+x][k]
+					}
+				}
+			}
+
+			for k := range f {
+				f[k] /= float64(width * height)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(base83((cx-1)+(cy-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+
+	maximum := 0.0
+	for _, f := range ac {
+		for _, v := range f {
+			maximum = math.Max(maximum, math.Abs(v))
+		}
+	}
+	quantised := int(math.Max(0, math.Min(82, math.Floor(maximum*166-0.5))))
+	maximum = float64(quantised+1) / 166
+	hash.WriteString(base83(quantised, 1))
+
+	hash.WriteString(base83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+
+	for _, f := range ac {
+		var q [3]int
+		for k, v := range f {
+			q[k] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		hash.WriteString(base83(q[0]*19*19+q[1]*19+q[2], 2))
+	}
+
+	return hash.String()
+}
@@ -0,0 +1,115 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBase83(t *testing.T) {
+	cases := map[int]string{
+		0:        "0000",
+		82:       "000~",
+		83:       "0010",
+		16711680: "TI:j",
+	}
+
+	for value, expected := range cases {
+		if s := base83(value, 4); s != expected {
+			t.Errorf("%d: expected %s; got %s", value, expected, s)
+		}
+	}
+}
+
+func TestBlurHashSolid(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.ZP, draw.Src)
+
+	hash := blurHash(img)
+	if len(hash) != 28 {
+		t.Fatalf("Expected 28 characters; got %q", hash)
+	}
+
+	// 4x3 components, then the average color, pure red
+	if hash[0] != 'L' || hash[2:6] != "TI:j" {
+		t.Errorf("Unexpected hash %s", hash)
+	}
+}
+
+func TestBlurHashGradient(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 30, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 30; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(y * 4), uint8(x * 8), 128, 255})
+		}
+	}
+
+	hash := blurHash(img)
+	if len(hash) != 28 {
+		t.Fatalf("Expected 28 characters; got %q", hash)
+	}
+
+	// Portrait images get four vertical components
+	if hash[0] != 'T' {
+		t.Errorf("Expected a 3x4 size flag; got %q", hash[0])
+	}
+	if hash[1] == '0' {
+		t.Error("Expected a non-zero AC range for a gradient")
+	}
+}
+
+func TestNewPlaceholder(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{0, 0, 255, 128}), image.ZP, draw.Src)
+
+	p, err := NewPlaceholder(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := "data:image/jpeg;base64,"
+	if !strings.HasPrefix(p.LQIP, prefix) {
+		t.Fatalf("Unexpected LQIP: %s", p.LQIP)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(p.LQIP[len(prefix):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview, err := jpeg.Decode(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := preview.Bounds().Size(); size != image.Pt(16, 8) {
+		t.Errorf("Expected a 16x8 preview; got %v", size)
+	}
+
+	// Transparency is flattened onto white rather than black
+	r, g, b, _ := preview.At(8, 4).RGBA()
+	if r>>8 < 96 || g>>8 < 96 || b>>8 < 200 {
+		t.Errorf("Expected a light blue preview; got %d, %d, %d", r>>8, g>>8, b>>8)
+	}
+}
+
+func TestNewPlaceholderMemory(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2000, 2000))
+
+	// The image is shrunk before anything full-size is allocated, so
+	// placeholders stay within what Reserve budgets for the decode
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := NewPlaceholder(img); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(len(img.Pix))/4 {
+		t.Errorf("Expected well under %d bytes allocated; got %d", len(img.Pix), allocated)
+	}
+}
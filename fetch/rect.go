@@ -0,0 +1,120 @@
+package fetch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+var ErrInvalidRect = errors.New("rect is outside the image")
+
+// Rect is a region of the original to extract before resizing, in
+// pixels or, when Percent is set, percentages of the upright image.
+type Rect struct {
+	X, Y, Width, Height float64
+	Percent             bool
+}
+
+// ParseRect reads an "x,y,w,h" region. Either every value is a whole
+// number of pixels or every value is a percentage ending in "%".
+func ParseRect(s string) (*Rect, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, false
+	}
+
+	r := &Rect{Percent: strings.HasSuffix(strings.TrimSpace(parts[0]), "%")}
+	values := make([]float64, 4)
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if strings.HasSuffix(part, "%") != r.Percent {
+			return nil, false
+		}
+
+		var err error
+		if r.Percent {
+			values[i], err = strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+			// Rounded so near-identical regions share a cache key
+			values[i] = math.Round(values[i]*100) / 100
+		} else {
+			var n int
+			n, err = strconv.Atoi(part)
+			values[i] = float64(n)
+		}
+		if err != nil || math.IsNaN(values[i]) || values[i] < 0 {
+			return nil, false
+		}
+	}
+
+	r.X, r.Y, r.Width, r.Height = values[0], values[1], values[2], values[3]
+	if r.Width == 0 || r.Height == 0 {
+		return nil, false
+	}
+	if r.Percent && (r.X+r.Width > 100 || r.Y+r.Height > 100) {
+		return nil, false
+	}
+
+	return r, true
+}
+
+func (r *Rect) String() string {
+	s := fmt.Sprintf("%g,%g,%g,%g", r.X, r.Y, r.Width, r.Height)
+	if r.Percent {
+		return "pct/" + s
+	}
+
+	return s
+}
+
+// bounds is the region within a width x height image, which it has to
+// lie entirely inside.
+func (r *Rect) bounds(width, height int) (image.Rectangle, error) {
+	x, y, w, h := r.X, r.Y, r.Width, r.Height
+	if r.Percent {
+		x, w = x*float64(width)/100, w*float64(width)/100
+		y, h = y*float64(height)/100, h*float64(height)/100
+	}
+
+	region := image.Rect(int(math.Round(x)), int(math.Round(y)), int(math.Round(x+w)), int(math.Round(y+h)))
+	if region.Empty() || !region.In(image.Rect(0, 0, width, height)) {
+		return region, ErrInvalidRect
+	}
+
+	return region, nil
+}
+
+// extract crops an upright original to a region, re-encoding it in its
+// own format. quality only matters for JPEGs.
+func extract(raw []byte, r *Rect, quality int) ([]byte, error) {
+	img, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	size := img.Bounds().Size()
+	region, err := r.bounds(size.X, size.Y)
+	if err != nil {
+		return nil, err
+	}
+	cropped := imaging.Crop(img, region.Add(img.Bounds().Min))
+
+	buf := new(bytes.Buffer)
+	if format == "jpeg" {
+		err = jpeg.Encode(buf, cropped, &jpeg.Options{Quality: quality})
+	} else {
+		err = png.Encode(buf, cropped)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,51 @@
+package fetch
+
+import (
+	"image"
+	"testing"
+)
+
+func TestParseRect(t *testing.T) {
+	cases := map[string]Rect{
+		"10,20,300,200":       {10, 20, 300, 200, false},
+		" 0, 0, 1, 1":         {0, 0, 1, 1, false},
+		"10%,5%,50%,50%":      {10, 5, 50, 50, true},
+		"12.345%,0%,50%,100%": {12.35, 0, 50, 100, true},
+	}
+	for s, expected := range cases {
+		if r, ok := ParseRect(s); !ok || *r != expected {
+			t.Errorf("%q: expected %v; got %v (%v)", s, expected, r, ok)
+		}
+	}
+
+	for _, s := range []string{
+		"", "10,20,300", "10,20,300,200,1", "-1,0,10,10", "0,0,0,10",
+		"1.5,0,10,10", "10%,0,10,10", "60%,0%,50%,10%", "a,b,c,d",
+	} {
+		if _, ok := ParseRect(s); ok {
+			t.Errorf("%q: expected an invalid rect", s)
+		}
+	}
+}
+
+func TestRectBounds(t *testing.T) {
+	cases := []struct {
+		rect   Rect
+		region image.Rectangle
+		err    error
+	}{
+		{Rect{10, 20, 100, 50, false}, image.Rect(10, 20, 110, 70), nil},
+		{Rect{0, 0, 240, 150, false}, image.Rect(0, 0, 240, 150), nil},
+		{Rect{200, 0, 100, 50, false}, image.Rect(200, 0, 300, 50), ErrInvalidRect},
+		{Rect{0, 140, 10, 20, false}, image.Rect(0, 140, 10, 160), ErrInvalidRect},
+		{Rect{25, 50, 50, 50, true}, image.Rect(60, 75, 180, 150), nil},
+		{Rect{0, 0, 0.1, 0.1, true}, image.Rect(0, 0, 0, 0), ErrInvalidRect},
+	}
+
+	for _, c := range cases {
+		region, err := c.rect.bounds(240, 150)
+		if region != c.region || err != c.err {
+			t.Errorf("%v: expected %v (%v); got %v (%v)", c.rect, c.region, c.err, region, err)
+		}
+	}
+}
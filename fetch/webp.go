@@ -0,0 +1,60 @@
+package fetch
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+int
+vips_webpsave_from_buffer(void *buf, size_t len, int png, void **out, size_t *outlen, int quality)
+{
+    VipsImage *in = NULL;
+    int err;
+
+    if (png) {
+        err = vips_pngload_buffer(buf, len, &in, NULL);
+    } else {
+        err = vips_jpegload_buffer(buf, len, &in, NULL);
+    }
+    if (err != 0) {
+        return err;
+    }
+
+    err = vips_webpsave_buffer(in, out, outlen, "Q", quality, "strip", TRUE, NULL);
+    g_object_unref(in);
+    return err;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// encodeWebP converts a JPEG or PNG buffer to WebP using libvips,
+// which the vips package has already initialized.
+func encodeWebP(raw []byte, png bool, quality int) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("empty image")
+	}
+
+	isPNG := C.int(0)
+	if png {
+		isPNG = 1
+	}
+
+	var ptr unsafe.Pointer
+	length := C.size_t(0)
+
+	err := C.vips_webpsave_from_buffer(unsafe.Pointer(&raw[0]), C.size_t(len(raw)),
+		isPNG, &ptr, &length, C.int(quality))
+	if err != 0 {
+		s := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return nil, errors.New(s)
+	}
+	defer C.g_free(C.gpointer(ptr))
+
+	return C.GoBytes(ptr, C.int(length)), nil
+}
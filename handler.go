@@ -3,28 +3,44 @@ package main
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
 	"io"
 	"io/ioutil"
+	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/vokal/vip/config"
 	"github.com/vokal/vip/fetch"
+	"github.com/vokal/vip/store"
 
 	"github.com/golang/groupcache"
+	"github.com/golang/groupcache/lru"
 	"github.com/gorilla/mux"
 )
 
 type UploadResponse struct {
-	Url string `json:"url"`
+	Url      string            `json:"url,omitempty"`
+	Variants map[string]string `json:"variants,omitempty"`
+
+	// Only set for files in multipart uploads
+	Filename string `json:"filename,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// Set when the upload asks for X-Vip-Placeholder
+	*fetch.Placeholder
 }
 
 type ErrorResponse struct {
@@ -35,25 +51,167 @@ type Uploadable struct {
 	Data   io.Reader
 	Key    string
 	Length int64
+	Mime   string
+	Image  image.Image
 }
 
 type WarmupRequest string
 
+// keySet remembers bucket/image pairs, for a limited time when ttl is
+// set. groupcache has no way to evict or expire a key, so these stop
+// this node serving deleted images or asking storage again for
+// missing ones. Both expire so an image uploaded again under the same
+// key through another node is served once more.
+type keySet struct {
+	sync.Mutex
+	keys *lru.Cache
+	ttl  time.Duration
+}
+
+var (
+	deleted *keySet
+	missing *keySet
+)
+
+func newKeySet(ttl time.Duration) *keySet {
+	return &keySet{keys: lru.New(10000), ttl: ttl}
+}
+
+func (k *keySet) Add(bucket, id string) {
+	k.Lock()
+	k.keys.Add(bucket+"/"+id, time.Now().Add(k.ttl))
+	k.Unlock()
+}
+
+func (k *keySet) Remove(bucket, id string) {
+	k.Lock()
+	k.keys.Remove(bucket + "/" + id)
+	k.Unlock()
+}
+
+func (k *keySet) Contains(bucket, id string) bool {
+	k.Lock()
+	defer k.Unlock()
+
+	expires, ok := k.keys.Get(bucket + "/" + id)
+	if ok && k.ttl > 0 && time.Now().After(expires.(time.Time)) {
+		k.keys.Remove(bucket + "/" + id)
+		return false
+	}
+
+	return ok
+}
+
+// modTimes remembers when originals were stored so conditional
+// requests don't need a round trip to storage. Originals never change
+// once uploaded, but entries are checked again after ttl so a node
+// learns of deletes made through another one.
+type modTimes struct {
+	sync.Mutex
+	times *lru.Cache
+	ttl   time.Duration
+}
+
+type modTime struct {
+	modified time.Time
+	expires  time.Time
+}
+
+var modified = newModTimes(0)
+
+func newModTimes(ttl time.Duration) *modTimes {
+	return &modTimes{times: lru.New(10000), ttl: ttl}
+}
+
+// Get returns the original's Last-Modified time, or the zero time if
+// storage doesn't know it. The error is storage's, so it has the
+// store.ErrNotFound kind once the original is deleted.
+func (m *modTimes) Get(bucket, id string) (time.Time, error) {
+	m.Lock()
+	t, ok := m.times.Get(bucket + "/" + id)
+	m.Unlock()
+	if ok && (m.ttl == 0 || time.Now().Before(t.(modTime).expires)) {
+		return t.(modTime).modified, nil
+	}
+
+	resp, err := storage.Head(bucket, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}, nil
+	}
+
+	m.Lock()
+	m.times.Add(bucket+"/"+id, modTime{modified, time.Now().Add(m.ttl)})
+	m.Unlock()
+
+	return modified, nil
+}
+
+func (m *modTimes) Remove(bucket, id string) {
+	m.Lock()
+	m.times.Remove(bucket + "/" + id)
+	m.Unlock()
+}
+
+// etag is a strong validator for an image's exact bytes.
+func etag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum(data))
+}
+
 type verifyAuth func(http.ResponseWriter, *http.Request)
 
 func (j *WarmupRequest) Run() {
-	resp, _ := http.Get(string(*j))
-	defer resp.Body.Close()
+	resp, err := http.Get(string(*j))
+	if err != nil {
+		log.Printf("warmup: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
 }
 
 func (h verifyAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	cors := false
-	token := false
+	cors := allowOrigin(w, r)
+
+	if !cors && !validToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if cors && r.Method == "OPTIONS" {
+		return
+	}
+
+	h(w, r)
+}
+
+// verifyDelete only lets a request through with a token. A browser on
+// an allowed origin can upload without one, but never delete.
+type verifyDelete func(http.ResponseWriter, *http.Request)
+
+func (h verifyDelete) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if allowOrigin(w, r) && r.Method == "OPTIONS" {
+		return
+	}
+
+	if !validToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
+	h(w, r)
+}
+
+// allowOrigin sets the CORS headers and reports whether the request
+// comes from an allowed origin.
+func allowOrigin(w http.ResponseWriter, r *http.Request) bool {
 	origin, err := url.Parse(r.Header.Get("Origin"))
 	if err != nil {
-		origin := url.URL{}
-		origin.Host = ""
+		origin = &url.URL{}
 	}
 
 	host := strings.Split(origin.Host, ":")[0]
@@ -61,30 +219,59 @@ func (h verifyAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for _, pattern := range origins {
 		match, _ := filepath.Match(pattern, host)
 		if match {
-			cors = true
 			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, PATCH, HEAD")
 			w.Header().Set("Access-Control-Allow-Headers",
-				"Accept, Content-Type, Content-Length, Accept-Encoding, X-Vip-Token, Authorization")
-			break
+				"Accept, Content-Type, Content-Length, Accept-Encoding, X-Vip-Token, Authorization, Upload-Length, Upload-Offset")
+			w.Header().Set("Access-Control-Expose-Headers",
+				"Location, Upload-Length, Upload-Offset, Upload-Expires")
+			return true
 		}
 	}
 
+	return false
+}
+
+// validToken reports whether the request carries the token its bucket
+// expects. With no token configured, no request has a valid one.
+func validToken(r *http.Request) bool {
+	expected := uploadToken(r)
 	auth := r.Header.Get("X-Vip-Token")
-	if auth == authToken {
-		token = true
+
+	return expected != "" && subtle.ConstantTimeCompare([]byte(auth), []byte(expected)) == 1
+}
+
+// uploadToken is the token the request's bucket expects, which is the
+// global one unless the bucket has its own.
+func uploadToken(r *http.Request) string {
+	if b, ok := config.Lookup(mux.Vars(r)["bucket_id"]); ok && b.UploadToken != "" {
+		return b.UploadToken
 	}
 
-	if !cors && !token {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	return authToken
+}
+
+// sizeLimit is the upload size limit for a bucket, in megabytes.
+func sizeLimit(b *config.Bucket) int64 {
+	if b.SizeLimit > 0 {
+		return b.SizeLimit
 	}
+	return limit
+}
 
-	if cors && r.Method == "OPTIONS" {
-		return
+// requestBucket looks up the bucket named in the route, responding
+// with a 404 if it isn't configured.
+func requestBucket(w http.ResponseWriter, r *http.Request) (*config.Bucket, bool) {
+	b, ok := config.Lookup(mux.Vars(r)["bucket_id"])
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: fmt.Sprintf("Unknown bucket %q", mux.Vars(r)["bucket_id"]),
+		})
 	}
 
-	h(w, r)
+	return b, ok
 }
 
 func fileKey(bucket string, width int, height int) string {
@@ -96,6 +283,16 @@ func fileKey(bucket string, width int, height int) string {
 	return fmt.Sprintf("%x-%dx%d", hash.Sum(nil), width, height)
 }
 
+// contentKey names an upload by a hash of its contents, so uploading
+// the same image twice produces the same key.
+func contentKey(raw []byte, width int, height int) string {
+	return fmt.Sprintf("%x-%dx%d", sha256.Sum256(raw), width, height)
+}
+
+func dedupes(b *config.Bucket) bool {
+	return dedupe || b.Dedupe
+}
+
 func makeWarmupRequest(path, query string) WarmupRequest {
 	var port string
 	if secure {
@@ -106,10 +303,53 @@ func makeWarmupRequest(path, query string) WarmupRequest {
 	return WarmupRequest(fmt.Sprintf("localhost:%s%s?%s", port, path, query))
 }
 
+// warmupQueries splits the comma-delimited X-Vip-Warmup header(s)
+// into individual query strings.
+func warmupQueries(h http.Header) []string {
+	var queries []string
+	for _, v := range h["X-Vip-Warmup"] {
+		for _, query := range strings.Split(v, ",") {
+			if query = strings.TrimSpace(query); query != "" {
+				queries = append(queries, query)
+			}
+		}
+	}
+
+	return queries
+}
+
+// wantsPlaceholder reports whether an upload asked for placeholders to
+// be returned along with its URL.
+func wantsPlaceholder(h http.Header) bool {
+	v, _ := strconv.ParseBool(h.Get("X-Vip-Placeholder"))
+	return v
+}
+
 func handleWarmup(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requestBucket(w, r); !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	bucket := vars["bucket_id"]
+	path := fmt.Sprintf("/%s/%s", bucket, vars["image_id"])
+
+	queries := warmupQueries(r.Header)
+
+	// Warmups must carry the same signatures a direct request would
+	for _, v := range queries {
+		query, err := url.ParseQuery(v)
+		if err != nil || !verifySignature(bucket, path, query) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Msg: fmt.Sprintf("Invalid or missing signature for warmup %q", v),
+			})
+			return
+		}
+	}
 
-	path := strings.Replace(r.URL.Path, "warmup/", "", 1)
-	for _, v := range r.Header["X-Vip-Warmup"] {
+	for _, v := range queries {
 		job := makeWarmupRequest(path, v)
 		Queue.Push(&job)
 	}
@@ -121,25 +361,235 @@ func handleImageRequest(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 
-	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	b, ok := requestBucket(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["image_id"]
+	if uploadKey(id) || deleted.Contains(b.Name, id) || missing.Contains(b.Name, id) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: "Image not found",
+		})
+		return
+	}
+
+	if !verifySignature(b.Name, r.URL.Path, r.URL.Query()) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: "Invalid or missing URL signature",
+		})
+		return
+	}
+
+	name := r.FormValue("p")
+	preset, ok := b.Preset(name)
+	if name != "" && !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: fmt.Sprintf("Unknown preset %q", name),
+		})
+		return
+	}
+
+	for _, param := range fetch.TransformParams {
+		if r.FormValue(param) != "" && b.PresetsOnly {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Msg: fmt.Sprintf("Only presets can be used with this bucket, not the %q parameter", param),
+			})
+			return
+		}
+		if r.FormValue(param) != "" && !b.Allows(param) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{
+				Msg: fmt.Sprintf("The %q parameter is not allowed for this bucket", param),
+			})
+			return
+		}
+	}
 
-	// Client is checking for a cached URI, assume it is valid
-	// and return a 304
-	if r.Header.Get("If-Modified-Since") != "" {
-		w.WriteHeader(http.StatusNotModified)
+	// RequestContext can only leave out a rect it can't parse
+	rect := r.FormValue("rect")
+	if v := preset.Get("rect"); v != "" {
+		rect = v
+	}
+	if _, ok := fetch.ParseRect(rect); rect != "" && !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: fmt.Sprintf("Invalid rect %q; use x,y,w,h in whole pixels or in percentages within 100%%", rect),
+		})
 		return
 	}
 
+	if b.CacheControl != "" {
+		w.Header().Set("Cache-Control", b.CacheControl)
+	} else {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+
+	// Without an explicit format the response is negotiated from Accept
+	format := r.FormValue("fmt")
+	if v := preset.Get("fmt"); v != "" {
+		format = v
+	}
+	if _, ok := fetch.ParseFormat(format); !ok {
+		w.Header().Set("Vary", "Accept")
+	}
+
 	gc := fetch.RequestContext(r)
 
+	// Keys are only unique within a bucket, and content-addressed ones
+	// can be the same in several
 	var data []byte
-	err := cache.Get(gc, gc.CacheKey(), groupcache.AllocatingByteSliceSink(&data))
+	err := cache.Get(gc, b.Name+"/"+gc.CacheKey(), groupcache.AllocatingByteSliceSink(&data))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status, msg := errorStatus(err)
+		if status == http.StatusNotFound {
+			missing.Add(b.Name, id)
+		}
+		if status >= 500 {
+			log.Printf("%s/%s: %s", b.Name, id, err.Error())
+		}
+
+		// Errors must not be cached downstream
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: msg,
+		})
+		return
+	}
+
+	// groupcache keeps copies of images deleted through other nodes
+	lastModified, err := modified.Get(b.Name, id)
+	if store.KindOf(err) == store.ErrNotFound {
+		deleted.Add(b.Name, id)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: "Image not found",
+		})
+		return
 	}
 
+	// ServeContent answers If-None-Match and If-Modified-Since
+	w.Header().Set("ETag", etag(data))
 	w.Header().Set("Content-Type", http.DetectContentType(data))
-	http.ServeContent(w, r, gc.ImageId, time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), bytes.NewReader(data))
+	http.ServeContent(w, r, gc.ImageId, lastModified, bytes.NewReader(data))
+}
+
+func handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, ok := requestBucket(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["image_id"]
+	if uploadKey(id) || deleted.Contains(b.Name, id) || missing.Contains(b.Name, id) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: "Image not found",
+		})
+		return
+	}
+
+	if !verifySignature(b.Name, r.URL.Path, r.URL.Query()) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: "Invalid or missing URL signature",
+		})
+		return
+	}
+
+	gc := &fetch.CacheContext{
+		ImageId: id,
+		Bucket:  b.Name,
+	}
+
+	// Info depends on the bucket's metadata policy, so the bucket is
+	// part of the key
+	var data []byte
+	err := infoCache.Get(gc, b.Name+"/"+id, groupcache.AllocatingByteSliceSink(&data))
+	if err != nil {
+		status, msg := errorStatus(err)
+		if status == http.StatusNotFound {
+			missing.Add(b.Name, id)
+		}
+		if status >= 500 {
+			log.Printf("%s/%s info: %s", b.Name, id, err.Error())
+		}
+
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: msg,
+		})
+		return
+	}
+
+	// Info holds previews and camera details, so it goes with the image
+	if _, err := modified.Get(b.Name, id); store.KindOf(err) == store.ErrNotFound {
+		deleted.Add(b.Name, id)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: "Image not found",
+		})
+		return
+	}
+
+	if b.CacheControl != "" {
+		w.Header().Set("Cache-Control", b.CacheControl)
+	} else {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// errorStatus maps an error from fetching an image to the response
+// status and message the client sees.
+func errorStatus(err error) (int, string) {
+	switch err {
+	case fetch.ErrUnsupportedFormat:
+		return http.StatusUnsupportedMediaType, "The image format is not supported"
+	case fetch.ErrTooLarge:
+		return http.StatusUnprocessableEntity, "The image is too large to process"
+	case fetch.ErrInvalidRect:
+		return http.StatusBadRequest, "The rect is outside the image"
+	}
+
+	switch store.KindOf(err) {
+	case store.ErrNotFound:
+		return http.StatusNotFound, "Image not found"
+	case store.ErrForbidden:
+		return http.StatusForbidden, "Access to the image was denied by storage"
+	case store.ErrBadResponse:
+		return http.StatusBadGateway, "Storage returned an unexpected error"
+	case store.ErrUnavailable:
+		return http.StatusServiceUnavailable, "Storage is temporarily unavailable"
+	}
+
+	return http.StatusInternalServerError, "The image could not be processed"
 }
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
@@ -150,7 +600,22 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
 
-	if r.ContentLength > limit<<20 {
+	b, ok := requestBucket(w, r)
+	if !ok {
+		return
+	}
+
+	limit := sizeLimit(b)
+
+	// A batch may carry several files, each within the limit
+	batch := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	max := limit << 20
+	if batch {
+		max *= int64(batchLimit)
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+
+	if r.ContentLength > max {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusRequestEntityTooLarge)
 		json.NewEncoder(w).Encode(ErrorResponse{
@@ -166,23 +631,143 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vars := mux.Vars(r)
-	bucket := vars["bucket_id"]
-	mime := r.Header.Get("Content-Type")
+	if batch {
+		handleBatchUpload(w, r, b, limit)
+		return
+	} else if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		handleRemoteUpload(w, r, b, limit)
+		return
+	}
 
-	data, err := processFile(r.Body, mime, bucket)
+	response, status, err := storeUpload(r, b, r.Body, r.Header.Get("Content-Type"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeUploadError(w, status, err.Error())
+		return
 	}
 
-	err = storage.PutReader(bucket, data.Key, data.Data,
-		data.Length, r.Header.Get("Content-Type"))
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleBatchUpload stores every file in a multipart/form-data upload,
+// responding with one entry per file in the order they were sent. A
+// file that fails gets an error entry without affecting the others.
+func handleBatchUpload(w http.ResponseWriter, r *http.Request, b *config.Bucket, limit int64) {
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Msg: err.Error()})
+		return
+	}
+
+	responses := []UploadResponse{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Msg: err.Error()})
+			return
+		}
+
+		// Other form fields are ignored
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		response := &UploadResponse{}
+		raw, err := ioutil.ReadAll(io.LimitReader(part, limit<<20+1))
+		part.Close()
+
+		switch {
+		case err != nil:
+			response.Error = err.Error()
+		case len(responses) >= batchLimit:
+			response.Error = fmt.Sprintf("Only %d files can be uploaded at once", batchLimit)
+		case int64(len(raw)) > limit<<20:
+			response.Error = fmt.Sprintf("The file size limit is %dMB", limit)
+		case len(raw) == 0:
+			response.Error = "File must have size greater than 0"
+		default:
+			response, _, err = storeUpload(r, b, bytes.NewReader(raw), part.Header.Get("Content-Type"))
+			if err != nil {
+				response = &UploadResponse{Error: err.Error()}
+			}
+		}
+
+		response.Filename = part.FileName()
+		responses = append(responses, *response)
+	}
+
+	if len(responses) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Msg: "No files were uploaded"})
 		return
 	}
 
-	uri := r.URL
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responses)
+}
+
+// storeUpload processes and stores a single image, returning its
+// response and status. On error the status describes the failure.
+func storeUpload(r *http.Request, b *config.Bucket, src io.Reader, mime string) (*UploadResponse, int, error) {
+	bucket := b.Name
+
+	var focal *fetch.FocalPoint
+	if v := r.Header.Get("X-Vip-Focal-Point"); v != "" {
+		var ok bool
+		if focal, ok = fetch.ParseFocalPoint(v); !ok {
+			return nil, http.StatusBadRequest, errors.New("X-Vip-Focal-Point must be an x,y pair of fractions from 0 to 1")
+		}
+	}
+
+	data, err := processFile(src, mime, bucket)
+	if e, ok := err.(*uploadError); ok {
+		return nil, e.status, err
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Content-addressed keys that already exist are the same image,
+	// so the stored copy is reused
+	status := http.StatusCreated
+	if dedupes(b) {
+		_, err := storage.Head(bucket, data.Key)
+		switch {
+		case err == nil:
+			status = http.StatusOK
+		case store.KindOf(err) != store.ErrNotFound:
+			code, _ := errorStatus(err)
+			return nil, code, err
+		}
+	}
+
+	if status == http.StatusCreated {
+		err = storage.PutReader(bucket, data.Key, data.Data, data.Length, data.Mime)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		// A duplicate keeps the focal point its crops were cached with
+		if focal != nil {
+			if err := fetch.WriteFocalPoint(storage, bucket, data.Key, focal); err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+		}
+	}
+	missing.Remove(bucket, data.Key)
+	deleted.Remove(bucket, data.Key)
+	modified.Remove(bucket, data.Key)
+
+	uri := *r.URL
 
 	if r.URL.Host == "" {
 		uri.Host = hostname
@@ -193,19 +778,107 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	uri.Path = fmt.Sprintf("%s/%s", bucket, data.Key)
-
-	w.Header().Set("Content-Type", "application/json")
+	uri.Path = fmt.Sprintf("/%s/%s", bucket, data.Key)
+	uri.RawQuery = signQuery(bucket, uri.Path, "")
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(UploadResponse{
+	response := &UploadResponse{
 		Url: uri.String(),
-	})
+	}
+
+	if wantsPlaceholder(r.Header) {
+		response.Placeholder, err = fetch.NewPlaceholder(data.Image)
+		if err != nil {
+			log.Printf("Placeholder for %s/%s failed: %s", bucket, data.Key, err.Error())
+		}
+	}
 
-	for _, v := range r.Header["X-Vip-Warmup"] {
-		job := makeWarmupRequest(uri.Path, v)
+	for _, v := range warmupQueries(r.Header) {
+		variant := uri
+		variant.RawQuery = signQuery(bucket, uri.Path, v)
+
+		if response.Variants == nil {
+			response.Variants = make(map[string]string)
+		}
+		response.Variants[v] = variant.String()
+
+		job := makeWarmupRequest(uri.Path, variant.RawQuery)
 		Queue.Push(&job)
 	}
+
+	return response, status, nil
+}
+
+// handleDelete removes an original along with every derivative
+// stored under its key. Deletes are idempotent.
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, ok := requestBucket(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["image_id"]
+
+	// Resumable uploads share the bucket, but aren't images
+	if uploadKey(id) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: "Image not found",
+		})
+		return
+	}
+
+	// Stop serving it here straight away; other nodes notice once
+	// they next check the original
+	deleted.Add(b.Name, id)
+	modified.Remove(b.Name, id)
+
+	count, err := deleteDerivatives(b.Name, id)
+	if err == nil {
+		// Remove the original last so a failure can be retried
+		err = storage.Delete(b.Name, id)
+	}
+	if err == nil {
+		// A derivative being written while this ran may have missed
+		// the first pass
+		var late int
+		late, err = deleteDerivatives(b.Name, id)
+		count += late
+	}
+	if err != nil {
+		deleted.Remove(b.Name, id)
+		log.Printf("Deleting %s/%s: %s", b.Name, id, err.Error())
+		status, msg := errorStatus(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Msg: msg,
+		})
+		return
+	}
+
+	log.Printf("Deleted %s/%s and %d derivative(s)", b.Name, id, count)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteDerivatives(bucket, id string) (int, error) {
+	keys, err := storage.List(bucket, id+"/")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		if err := storage.Delete(bucket, key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), nil
 }
 
 func handlePing(w http.ResponseWriter, r *http.Request) {
@@ -214,47 +887,62 @@ func handlePing(w http.ResponseWriter, r *http.Request) {
 }
 
 func processFile(src io.Reader, mime string, bucket string) (*Uploadable, error) {
-	if mime == "image/jpeg" || mime == "image/jpg" {
-		image, format, err := fetch.GetRotatedImage(src)
-		if err != nil {
-			return nil, err
-		}
-		if format != "jpeg" {
-			return nil, errors.New("You sent a bad JPEG file.")
-		}
-
-		width := image.Bounds().Size().X
-		height := image.Bounds().Size().Y
-		key := fileKey(bucket, width, height)
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
 
-		data := new(bytes.Buffer)
-		err = jpeg.Encode(data, image, nil)
-		if err != nil {
-			return nil, err
-		}
-		length := int64(data.Len())
+	b, ok := config.Lookup(bucket)
+	if !ok {
+		b = &config.Bucket{}
+	}
 
-		return &Uploadable{data, key, length}, nil
+	format := sniffFormat(raw)
+	if err := validateFormat(&b.Validation, format); err != nil {
+		return nil, err
+	}
+	if (mime == "image/jpeg" || mime == "image/jpg") && format != "jpeg" {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, "You sent a bad JPEG file."}
+	}
 
-	} else {
-		raw, err := ioutil.ReadAll(src)
-		if err != nil {
-			return nil, err
-		}
+	// Dimensions are checked before anything is decoded
+	size, err := fetch.CheckSize(raw)
+	if err != nil {
+		status, msg := errorStatus(err)
+		return nil, &uploadError{status, msg}
+	}
+	width, height := fetch.UprightSize(raw, size)
+	if err := validateSize(&b.Validation, width, height); err != nil {
+		return nil, err
+	}
+	release := fetch.Reserve(size)
+	defer release()
 
-		data := bytes.NewReader(raw)
-		length := int64(data.Len())
-		image, _, err := image.Decode(data)
-		if err != nil {
-			return nil, err
-		}
+	raw, err = fetch.AutoOrient(raw)
+	if err != nil {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, err.Error()}
+	}
 
-		width := image.Bounds().Size().X
-		height := image.Bounds().Size().Y
-		key := fileKey(bucket, width, height)
+	// Decoded upright, so the key, limits and placeholders match
+	// what's served
+	img, format, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, err.Error()}
+	}
 
-		data.Seek(0, 0)
+	// Stored as it is, the metadata could keep what the policy removes
+	raw, removed, err := fetch.StripMetadata(raw, fetch.BucketMetadataPolicy(b))
+	if err != nil {
+		return nil, &uploadError{http.StatusUnprocessableEntity, "The image metadata is malformed and can't be removed."}
+	}
+	if *verbose && len(removed) > 0 {
+		log.Printf("Removed metadata from upload to %s: %s", bucket, strings.Join(removed, ", "))
+	}
 
-		return &Uploadable{data, key, length}, nil
+	key := fileKey(bucket, img.Bounds().Dx(), img.Bounds().Dy())
+	if dedupes(b) {
+		key = contentKey(raw, img.Bounds().Dx(), img.Bounds().Dy())
 	}
+
+	return &Uploadable{bytes.NewReader(raw), key, int64(len(raw)), "image/" + format, img}, nil
 }
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vokal/vip/config"
+	"github.com/vokal/vip/store"
+	"github.com/vokal/vip/test"
+	. "gopkg.in/check.v1"
+)
+
+var (
+	_ = Suite(&ImageSuite{})
+)
+
+type ImageSuite struct{}
+
+func (s *ImageSuite) SetUpSuite(c *C) {
+	setUpSuite(c)
+}
+
+func (s *ImageSuite) SetUpTest(c *C) {
+	setUpTest(c)
+
+	storage = test.NewStore()
+}
+
+func (s *ImageSuite) insertImage(c *C, id string) {
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	err = storage.Put("samplebucket", id, file, "image/jpeg")
+	c.Assert(err, IsNil)
+}
+
+func (s *ImageSuite) request(c *C, uri string, header http.Header) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+
+	// Mock up a router so that mux.Vars are passed
+	// correctly
+	m := mux.NewRouter()
+	m.HandleFunc("/{bucket_id}/{image_id}", handleImageRequest)
+
+	req, err := http.NewRequest("GET", uri, nil)
+	c.Assert(err, IsNil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	m.ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+func (s *ImageSuite) TestNegotiateWebP(c *C) {
+	s.insertImage(c, "negotiate")
+
+	recorder := s.request(c, "http://localhost:8080/samplebucket/negotiate?s=100", http.Header{
+		"Accept": {"image/webp,image/*,*/*;q=0.8"},
+	})
+
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.HeaderMap.Get("Content-Type"), Equals, "image/webp")
+	c.Assert(recorder.HeaderMap.Get("Vary"), Equals, "Accept")
+}
+
+func (s *ImageSuite) TestNegotiateFallback(c *C) {
+	s.insertImage(c, "fallback")
+
+	recorder := s.request(c, "http://localhost:8080/samplebucket/fallback?s=100", http.Header{
+		"Accept": {"image/png,image/*;q=0.8,*/*;q=0.5"},
+	})
+
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.HeaderMap.Get("Content-Type"), Equals, "image/jpeg")
+	c.Assert(recorder.HeaderMap.Get("Vary"), Equals, "Accept")
+}
+
+func (s *ImageSuite) TestExplicitFormat(c *C) {
+	s.insertImage(c, "explicit")
+
+	recorder := s.request(c, "http://localhost:8080/samplebucket/explicit?fmt=png", http.Header{
+		"Accept": {"image/webp,*/*"},
+	})
+
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.HeaderMap.Get("Content-Type"), Equals, "image/png")
+	c.Assert(recorder.HeaderMap.Get("Vary"), Equals, "")
+}
+
+func (s *ImageSuite) TestSignedRequest(c *C) {
+	signingKey = "lalalasecretlalala"
+	defer func() { signingKey = "" }()
+
+	s.insertImage(c, "signed")
+
+	recorder := s.request(c, "http://localhost:8080/samplebucket/signed?s=100", nil)
+	c.Assert(recorder.Code, Equals, http.StatusForbidden)
+
+	query := signQuery("samplebucket", "/samplebucket/signed", "s=100")
+	recorder = s.request(c, "http://localhost:8080/samplebucket/signed?"+query, nil)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+
+	// A signature for one size can't be reused for another
+	recorder = s.request(c, "http://localhost:8080/samplebucket/signed?"+
+		strings.Replace(query, "s=100", "s=200", 1), nil)
+	c.Assert(recorder.Code, Equals, http.StatusForbidden)
+}
+
+func (s *ImageSuite) TestUnknownBucket(c *C) {
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+	defer config.Set(nil)
+
+	recorder := s.request(c, "http://localhost:8080/otherbucket/abc?s=100", nil)
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+
+	var e ErrorResponse
+	err = json.NewDecoder(recorder.Body).Decode(&e)
+	c.Assert(err, IsNil)
+	c.Assert(e.Msg, Equals, `Unknown bucket "otherbucket"`)
+}
+
+func (s *ImageSuite) TestBucketTransformations(c *C) {
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+	defer config.Set(nil)
+
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+	err = storage.Put("avatars", "transformations", file, "image/jpeg")
+	c.Assert(err, IsNil)
+
+	recorder := s.request(c, "http://localhost:8080/avatars/transformations?s=100&h=50", nil)
+	c.Assert(recorder.Code, Equals, http.StatusBadRequest)
+
+	// The bucket defaults to WebP output
+	recorder = s.request(c, "http://localhost:8080/avatars/transformations?s=100&c=true", nil)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.HeaderMap.Get("Content-Type"), Equals, "image/webp")
+	c.Assert(recorder.HeaderMap.Get("Cache-Control"), Equals, "public, max-age=3600")
+}
+
+// failingStore fails every read with the given error.
+type failingStore struct {
+	*test.Store
+	err error
+}
+
+func (f failingStore) GetReader(bucket, path string) (io.ReadCloser, error) {
+	return nil, f.err
+}
+
+func (s *ImageSuite) TestMissingImage(c *C) {
+	recorder := s.request(c, "http://localhost:8080/samplebucket/missing?s=100", nil)
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+	c.Assert(recorder.HeaderMap.Get("Content-Type"), Equals, "application/json")
+
+	var e ErrorResponse
+	err := json.NewDecoder(recorder.Body).Decode(&e)
+	c.Assert(err, IsNil)
+	c.Assert(e.Msg, Equals, "Image not found")
+
+	// The miss is remembered, so storage isn't asked again
+	s.insertImage(c, "missing")
+	recorder = s.request(c, "http://localhost:8080/samplebucket/missing?s=200", nil)
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+
+	missing.Remove("samplebucket", "missing")
+	recorder = s.request(c, "http://localhost:8080/samplebucket/missing?s=200", nil)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+}
+
+func (s *ImageSuite) TestUnsupportedImage(c *C) {
+	err := storage.Put("samplebucket", "notanimage", []byte("plain text"), "text/plain")
+	c.Assert(err, IsNil)
+
+	recorder := s.request(c, "http://localhost:8080/samplebucket/notanimage?s=100", nil)
+	c.Assert(recorder.Code, Equals, http.StatusUnsupportedMediaType)
+}
+
+func (s *ImageSuite) TestDecodeBomb(c *C) {
+	bomb := test.BombPNG(50000, 50000)
+	err := storage.Put("samplebucket", "bomb", bomb, "image/png")
+	c.Assert(err, IsNil)
+
+	recorder := s.request(c, "http://localhost:8080/samplebucket/bomb?s=100", nil)
+	c.Assert(recorder.Code, Equals, http.StatusUnprocessableEntity)
+
+	// The original is served as stored, without decoding it
+	recorder = s.request(c, "http://localhost:8080/samplebucket/bomb", nil)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.Body.Bytes(), DeepEquals, bomb)
+}
+
+func (s *ImageSuite) TestPresets(c *C) {
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+	defer config.Set(nil)
+
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+	err = storage.Put("gallery", "presets", file, "image/jpeg")
+	c.Assert(err, IsNil)
+
+	recorder := s.request(c, "http://localhost:8080/gallery/presets?p=thumb", nil)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	size, _, err := image.DecodeConfig(recorder.Body)
+	c.Assert(err, IsNil)
+	c.Check(size.Width, Equals, 150)
+	c.Check(size.Height, Equals, 150)
+
+	// A preset's format is explicit, so nothing is negotiated
+	recorder = s.request(c, "http://localhost:8080/gallery/presets?p=hero", http.Header{
+		"Accept": {"image/webp,*/*"},
+	})
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Check(recorder.HeaderMap.Get("Content-Type"), Equals, "image/webp")
+	c.Check(recorder.HeaderMap.Get("Vary"), Equals, "")
+
+	for uri, msg := range map[string]string{
+		"/gallery/presets?p=poster":        `Unknown preset "poster"`,
+		"/gallery/presets?s=160&c=true":    `Only presets can be used with this bucket, not the "s" parameter`,
+		"/gallery/presets?p=thumb&fmt=png": `Only presets can be used with this bucket, not the "fmt" parameter`,
+	} {
+		recorder = s.request(c, "http://localhost:8080"+uri, nil)
+		c.Check(recorder.Code, Equals, http.StatusBadRequest, Commentf(uri))
+
+		var e ErrorResponse
+		c.Assert(json.NewDecoder(recorder.Body).Decode(&e), IsNil)
+		c.Check(e.Msg, Equals, msg, Commentf(uri))
+	}
+
+	// The original can still be requested without a preset
+	recorder = s.request(c, "http://localhost:8080/gallery/presets", nil)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.HeaderMap.Get("Content-Type"), Equals, "image/jpeg")
+}
+
+func (s *ImageSuite) TestRect(c *C) {
+	s.insertImage(c, "rect")
+
+	// The original is 240x150
+	for query, size := range map[string]image.Point{
+		"rect=10,20,100,50":            image.Pt(100, 50),
+		"rect=10,20,100,50&s=50":       image.Pt(50, 25),
+		"rect=0%25,0%25,50%25,100%25":  image.Pt(120, 150),
+		"rect=0,0,240,150&s=60&c=true": image.Pt(60, 60),
+	} {
+		recorder := s.request(c, "http://localhost:8080/samplebucket/rect?"+query, nil)
+		c.Assert(recorder.Code, Equals, http.StatusOK, Commentf(query))
+
+		config, _, err := image.DecodeConfig(recorder.Body)
+		c.Assert(err, IsNil)
+		c.Check(image.Pt(config.Width, config.Height), Equals, size, Commentf(query))
+	}
+
+	recorder := s.request(c, "http://localhost:8080/samplebucket/rect?rect=200,0,100,50", nil)
+	c.Assert(recorder.Code, Equals, http.StatusBadRequest)
+
+	var e ErrorResponse
+	c.Assert(json.NewDecoder(recorder.Body).Decode(&e), IsNil)
+	c.Assert(e.Msg, Equals, "The rect is outside the image")
+
+	// Rects that can't be parsed aren't ignored
+	for _, rect := range []string{"10,20,100", "a,b,c,d", "10,20,100%25,50", "50%25,0%25,60%25,100%25", "0,0,0,10"} {
+		recorder := s.request(c, "http://localhost:8080/samplebucket/rect?rect="+rect, nil)
+		c.Check(recorder.Code, Equals, http.StatusBadRequest, Commentf(rect))
+		c.Check(recorder.HeaderMap.Get("Cache-Control"), Equals, "", Commentf(rect))
+	}
+}
+
+func (s *ImageSuite) TestSameIdInTwoBuckets(c *C) {
+	s.insertImage(c, "shared")
+
+	file, err := ioutil.ReadFile("test/test_inspiration.png")
+	c.Assert(err, IsNil)
+	c.Assert(storage.Put("otherbucket", "shared", file, "image/png"), IsNil)
+
+	// Each bucket gets its own image, not whichever was cached first
+	for bucket, size := range map[string]image.Point{"samplebucket": image.Pt(100, 62), "otherbucket": image.Pt(100, 68)} {
+		recorder := s.request(c, "http://localhost:8080/"+bucket+"/shared?s=100", nil)
+		c.Assert(recorder.Code, Equals, http.StatusOK)
+
+		config, _, err := image.DecodeConfig(recorder.Body)
+		c.Assert(err, IsNil)
+		c.Check(image.Pt(config.Width, config.Height), Equals, size, Commentf(bucket))
+	}
+}
+
+func (s *ImageSuite) TestStorageErrors(c *C) {
+	for i, t := range []struct {
+		kind   error
+		status int
+	}{
+		{store.ErrForbidden, http.StatusForbidden},
+		{store.ErrBadResponse, http.StatusBadGateway},
+		{store.ErrUnavailable, http.StatusServiceUnavailable},
+		{nil, http.StatusInternalServerError},
+	} {
+		err := errors.New("storage failed")
+		if t.kind != nil {
+			err = &store.Error{Kind: t.kind, Err: err}
+		}
+		storage = failingStore{test.NewStore(), err}
+
+		uri := fmt.Sprintf("http://localhost:8080/samplebucket/failing%d?s=100", i)
+		recorder := s.request(c, uri, nil)
+		c.Assert(recorder.Code, Equals, t.status)
+		c.Assert(recorder.HeaderMap.Get("Cache-Control"), Equals, "no-cache")
+
+		// Only misses are cached
+		c.Assert(missing.Contains("samplebucket", fmt.Sprintf("failing%d", i)), Equals, false)
+	}
+}
+
+func (s *ImageSuite) TestConditionalRequests(c *C) {
+	s.insertImage(c, "conditional")
+	uri := "http://localhost:8080/samplebucket/conditional?s=100"
+
+	recorder := s.request(c, uri, nil)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.HeaderMap.Get("Cache-Control"), Equals, "public, max-age=31536000")
+
+	tag := recorder.HeaderMap.Get("ETag")
+	c.Assert(tag, Matches, `"[0-9a-f]{40}"`)
+
+	lastModified, err := http.ParseTime(recorder.HeaderMap.Get("Last-Modified"))
+	c.Assert(err, IsNil)
+
+	// Other sizes are different representations
+	recorder = s.request(c, "http://localhost:8080/samplebucket/conditional?s=50", nil)
+	c.Assert(recorder.HeaderMap.Get("ETag"), Not(Equals), tag)
+
+	recorder = s.request(c, uri, http.Header{"If-None-Match": {tag}})
+	c.Assert(recorder.Code, Equals, http.StatusNotModified)
+	c.Assert(recorder.HeaderMap.Get("ETag"), Equals, tag)
+
+	recorder = s.request(c, uri, http.Header{"If-None-Match": {`"stale"`}})
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+
+	recorder = s.request(c, uri, http.Header{
+		"If-Modified-Since": {lastModified.Format(http.TimeFormat)},
+	})
+	c.Assert(recorder.Code, Equals, http.StatusNotModified)
+
+	recorder = s.request(c, uri, http.Header{
+		"If-Modified-Since": {lastModified.Add(-time.Hour).Format(http.TimeFormat)},
+	})
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vokal/vip/config"
+	"github.com/vokal/vip/fetch"
+	"github.com/vokal/vip/test"
+	. "gopkg.in/check.v1"
+)
+
+var (
+	_ = Suite(&InfoSuite{})
+)
+
+type InfoSuite struct{}
+
+func (s *InfoSuite) SetUpSuite(c *C) {
+	setUpSuite(c)
+}
+
+func (s *InfoSuite) SetUpTest(c *C) {
+	setUpTest(c)
+
+	storage = test.NewStore()
+}
+
+func (s *InfoSuite) insert(c *C, bucket, id, filename string) []byte {
+	file, err := ioutil.ReadFile(filename)
+	c.Assert(err, IsNil)
+
+	err = storage.Put(bucket, id, file, http.DetectContentType(file))
+	c.Assert(err, IsNil)
+
+	return file
+}
+
+func (s *InfoSuite) request(c *C, uri string) (*httptest.ResponseRecorder, *fetch.Info) {
+	recorder := httptest.NewRecorder()
+
+	// Mock up a router so that mux.Vars are passed
+	// correctly
+	m := mux.NewRouter()
+	m.HandleFunc("/{bucket_id}/{image_id}/info", handleInfo)
+
+	req, err := http.NewRequest("GET", uri, nil)
+	c.Assert(err, IsNil)
+	m.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		return recorder, nil
+	}
+
+	c.Assert(recorder.HeaderMap.Get("Content-Type"), Equals, "application/json")
+	info := &fetch.Info{}
+	c.Assert(json.NewDecoder(recorder.Body).Decode(info), IsNil)
+
+	return recorder, info
+}
+
+func (s *InfoSuite) TestInfo(c *C) {
+	file := s.insert(c, "samplebucket", "infojpeg", "test/awesome-small.jpg")
+
+	recorder, info := s.request(c, "http://localhost:8080/samplebucket/infojpeg/info")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Check(info.Width, Equals, 240)
+	c.Check(info.Height, Equals, 150)
+	c.Check(info.Format, Equals, "jpeg")
+	c.Check(info.Size, Equals, len(file))
+	c.Check(info.Frames, Equals, 1)
+	c.Check(info.Orientation, Equals, 1)
+	c.Check(info.DominantColor, Matches, "#[0-9a-f]{6}")
+	c.Check(info.BlurHash, HasLen, 28)
+	c.Check(info.LQIP, Matches, "data:image/jpeg;base64,.+")
+}
+
+func (s *InfoSuite) TestInfoOrientedAnimated(c *C) {
+	s.insert(c, "samplebucket", "infogif", "test/animated.gif")
+	s.insert(c, "samplebucket", "inforotated", "test/f6-exif.jpg")
+
+	_, info := s.request(c, "http://localhost:8080/samplebucket/infogif/info")
+	c.Check(info.Format, Equals, "gif")
+	c.Check(info.Frames, Equals, 2)
+
+	// Dimensions are as displayed
+	_, info = s.request(c, "http://localhost:8080/samplebucket/inforotated/info")
+	c.Check(info.Orientation, Equals, 6)
+	c.Check(info.Width, Equals, 40)
+	c.Check(info.Height, Equals, 80)
+}
+
+func (s *InfoSuite) TestInfoExif(c *C) {
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+	defer config.Set(nil)
+
+	s.insert(c, "samplebucket", "infoexif", "test/awesome.jpeg")
+	s.insert(c, "private", "infoexif", "test/awesome.jpeg")
+
+	// EXIF is only reported for buckets that keep it
+	_, info := s.request(c, "http://localhost:8080/samplebucket/infoexif/info")
+	c.Check(info.Exif, IsNil)
+
+	recorder, _ := s.request(c, "http://localhost:8080/private/infoexif/info")
+	c.Assert(recorder.Code, Equals, http.StatusForbidden)
+
+	query := signQuery("private", "/private/infoexif/info", "")
+	_, info = s.request(c, "http://localhost:8080/private/infoexif/info?"+query)
+	c.Check(info.Exif["Make"], Not(Equals), "")
+}
+
+func (s *InfoSuite) TestInfoMissing(c *C) {
+	recorder, _ := s.request(c, "http://localhost:8080/samplebucket/infomissing/info")
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+}
+
+func (s *InfoSuite) TestInfoDeletedElsewhere(c *C) {
+	s.insert(c, "samplebucket", "infodeleted", "test/awesome-small.jpg")
+
+	recorder, _ := s.request(c, "http://localhost:8080/samplebucket/infodeleted/info")
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+
+	// The cached info isn't served once the original is gone
+	saved := modified
+	defer func() { modified = saved }()
+	modified = newModTimes(time.Nanosecond)
+	c.Assert(storage.Delete("samplebucket", "infodeleted"), IsNil)
+
+	recorder, _ = s.request(c, "http://localhost:8080/samplebucket/infodeleted/info")
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+	c.Assert(deleted.Contains("samplebucket", "infodeleted"), Equals, true)
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"log/syslog"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/vokal/vip/config"
 	"github.com/vokal/vip/fetch"
 	"github.com/vokal/vip/peer"
 	"github.com/vokal/vip/store"
@@ -23,22 +27,27 @@ import (
 )
 
 const (
-	KeyFilePath  = "/etc/vip/application.key"
-	CertFilePath = "/etc/vip/application.pem"
+	KeyFilePath      = "/etc/vip/application.key"
+	CertFilePath     = "/etc/vip/application.pem"
+	BucketConfigPath = "/etc/vip/buckets.json"
 )
 
 var (
-	cache     *groupcache.Group
-	peers     peer.CachePool
-	storage   store.ImageStore
-	authToken string
-	origins   []string
-	limit     int64
-	hostname  string
-	verbose   *bool   = flag.Bool("verbose", false, "verbose logging")
-	httpport  *string = flag.String("httpport", "8080", "target port")
-	secure    bool    = false
-	Queue     q.Queue
+	cache        *groupcache.Group
+	infoCache    *groupcache.Group
+	peers        peer.CachePool
+	storage      store.ImageStore
+	authToken    string
+	origins      []string
+	limit        int64
+	batchLimit   int
+	hostname     string
+	cacheControl string
+	dedupe       bool
+	verbose      *bool   = flag.Bool("verbose", false, "verbose logging")
+	httpport     *string = flag.String("httpport", "8080", "target port")
+	secure       bool    = false
+	Queue        q.Queue
 )
 
 func listenHttp() {
@@ -60,8 +69,20 @@ func listenHttp() {
 	}
 }
 
+// getRegion returns the AWS region to use, or a custom region when
+// VIP_S3_ENDPOINT points at an S3-compatible service like MinIO.
 func getRegion() aws.Region {
 	region := os.Getenv("AWS_REGION")
+
+	if endpoint := os.Getenv("VIP_S3_ENDPOINT"); endpoint != "" {
+		pathStyle := strings.ToLower(os.Getenv("VIP_S3_PATH_STYLE")) != "false"
+		custom, err := customRegion(region, endpoint, pathStyle)
+		if err != nil {
+			log.Fatalf("Invalid VIP_S3_ENDPOINT: %s\n", err.Error())
+		}
+		return custom
+	}
+
 	aws_region, ok := aws.Regions[region]
 	if ok {
 		return aws_region
@@ -73,8 +94,59 @@ func getRegion() aws.Region {
 	}
 }
 
+func customRegion(name, endpoint string, pathStyle bool) (aws.Region, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return aws.Region{}, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return aws.Region{}, fmt.Errorf("%q is not an http(s) URL", endpoint)
+	}
+
+	if name == "" {
+		name = aws.USEast.Name
+	}
+
+	region := aws.Region{
+		Name:       name,
+		S3Endpoint: strings.TrimRight(endpoint, "/"),
+	}
+
+	// goamz addresses buckets by path unless given a bucket endpoint
+	if !pathStyle {
+		region.S3BucketEndpoint = fmt.Sprintf("%s://${bucket}.%s", u.Scheme, u.Host)
+	}
+
+	log.Printf("Using S3 endpoint %s (region %s, path-style %t)\n", region.S3Endpoint, name, pathStyle)
+	return region, nil
+}
+
+func getImage(c groupcache.Context, key string, dest groupcache.Sink) error {
+	log.Printf("Cache MISS for key -> %s", key)
+	// Get image data from S3
+	b, err := fetch.ImageData(storage, c)
+	if err != nil {
+		return err
+	}
+
+	return dest.SetBytes(b)
+}
+
+func getInfo(c groupcache.Context, key string, dest groupcache.Sink) error {
+	info, err := fetch.ImageInfo(storage, c)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return dest.SetBytes(b)
+}
+
 func init() {
-	flag.Parse()
 	var err error
 	hasKey := true
 	hasCert := true
@@ -98,6 +170,29 @@ func init() {
 		log.Println("No AUTH_TOKEN parameter provided, uploads are insecure")
 	}
 
+	signingKey = os.Getenv("VIP_SIGNING_KEY")
+	bucketSigningKeys = parseSigningKeys(os.Getenv("VIP_SIGNING_KEYS"))
+	if signingKey != "" || len(bucketSigningKeys) > 0 {
+		log.Println("URL signing is enabled; unsigned image requests will be rejected.")
+	}
+
+	bucketConfig := os.Getenv("VIP_BUCKET_CONFIG")
+	if bucketConfig == "" {
+		bucketConfig = BucketConfigPath
+	}
+
+	registry, err := config.Load(bucketConfig)
+	switch {
+	case err == nil:
+		config.Set(registry)
+		log.Printf("Loaded %d bucket(s) from %s; other buckets are rejected.\n",
+			len(registry.Buckets), bucketConfig)
+	case os.IsNotExist(err) && os.Getenv("VIP_BUCKET_CONFIG") == "":
+		log.Printf("No bucket config found at %s, all buckets are accepted.\n", bucketConfig)
+	default:
+		log.Fatalf("Error loading bucket config: %s\n", err.Error())
+	}
+
 	allowedOrigin := os.Getenv("ALLOWED_ORIGIN")
 	if allowedOrigin == "" {
 		log.Println("No ALLOWED_ORIGIN set, CORS support is disabled.")
@@ -117,27 +212,75 @@ func init() {
 	}
 	log.Printf("Max file size is set at %dMB.\n", limit)
 
+	batchLimit, err = strconv.Atoi(os.Getenv("VIP_BATCH_LIMIT"))
+	if err != nil || batchLimit < 1 {
+		batchLimit = 10
+	}
+
+	notFoundTTL, err := strconv.Atoi(os.Getenv("VIP_NOT_FOUND_TTL"))
+	if err != nil || notFoundTTL < 0 {
+		notFoundTTL = 60
+	}
+	deleted = newKeySet(time.Duration(notFoundTTL) * time.Second)
+	missing = newKeySet(time.Duration(notFoundTTL) * time.Second)
+	modified = newModTimes(time.Duration(notFoundTTL) * time.Second)
+
+	cacheControl = os.Getenv("VIP_CACHE_CONTROL")
+	if cacheControl == "" {
+		cacheControl = "public, max-age=31536000"
+	}
+
+	remoteTimeout, err := strconv.Atoi(os.Getenv("VIP_REMOTE_TIMEOUT"))
+	if err != nil || remoteTimeout < 1 {
+		remoteTimeout = 10
+	}
+	remoteAllow = parseNetworks(strings.Split(os.Getenv("VIP_REMOTE_ALLOW"), ","))
+	remote = newRemoteClient(time.Duration(remoteTimeout)*time.Second, remoteAllow)
+
+	expiry, err := strconv.Atoi(os.Getenv("VIP_UPLOAD_EXPIRY"))
+	if err != nil || expiry < 1 {
+		expiry = 86400
+	}
+	uploadExpiry = time.Duration(expiry) * time.Second
+
+	dedupe, _ = strconv.ParseBool(os.Getenv("VIP_DEDUPE"))
+	if dedupe {
+		log.Println("Uploads are keyed by content; duplicates reuse the stored image.")
+	}
+
 	hostname = os.Getenv("URI_HOSTNAME")
 	log.Printf("Hostname is set to \"%s\".\n", hostname)
 
 	r := mux.NewRouter()
 	r.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+	r.Handle("/upload/{bucket_id}/resumable", verifyAuth(handleCreateUpload))
+	r.Handle("/upload/{bucket_id}/resumable/{upload_id}", verifyAuth(handleResumableUpload))
 	r.HandleFunc("/{bucket_id}/{image_id}/warmup", handleWarmup)
+	r.HandleFunc("/{bucket_id}/{image_id}/info", handleInfo)
+	r.Handle("/{bucket_id}/{image_id}", verifyDelete(handleDelete)).Methods("DELETE", "OPTIONS")
 	r.HandleFunc("/{bucket_id}/{image_id}", handleImageRequest)
 	r.HandleFunc("/ping", handlePing)
 	http.Handle("/", r)
 }
 
 func main() {
+	flag.Parse()
+	fetch.Verbose = *verbose
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	awsAuth, err := aws.EnvAuth()
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
+	if root := os.Getenv("VIP_STORAGE_PATH"); root != "" {
+		log.Printf("Storing images on disk under %s\n", root)
+		storage = store.NewFileStore(root)
+	} else {
+		awsAuth, err := aws.EnvAuth()
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	s3conn := s3.New(awsAuth, getRegion())
-	storage = store.NewS3Store(s3conn)
+		s3conn := s3.New(awsAuth, getRegion())
+		storage = store.NewS3Store(s3conn)
+	}
 
 	peers = peer.DebugPool()
 
@@ -145,17 +288,8 @@ func main() {
 		return fetch.RequestContext(r)
 	})
 
-	cache = groupcache.NewGroup("ImageProxyCache", 64<<20, groupcache.GetterFunc(
-		func(c groupcache.Context, key string, dest groupcache.Sink) error {
-			log.Printf("Cache MISS for key -> %s", key)
-			// Get image data from S3
-			b, err := fetch.ImageData(storage, c)
-			if err != nil {
-				return err
-			}
-
-			return dest.SetBytes(b)
-		}))
+	cache = groupcache.NewGroup("ImageProxyCache", 64<<20, groupcache.GetterFunc(getImage))
+	infoCache = groupcache.NewGroup("ImageInfoCache", 8<<20, groupcache.GetterFunc(getInfo))
 
 	if !*verbose {
 		logwriter, err := syslog.Dial("udp", "app_syslog:514", syslog.LOG_NOTICE, "vip")
@@ -170,6 +304,11 @@ func main() {
 	go peers.Listen()
 	go listenHttp()
 	go Queue.Start(4)
+	go func() {
+		for range time.Tick(time.Hour) {
+			sweepUploads()
+		}
+	}()
 	log.Println("Cache listening on port :" + peers.Port())
 	s := &http.Server{
 		Addr:    ":" + peers.Port(),
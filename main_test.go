@@ -1,10 +1,12 @@
 package main
 
 import (
-	. "gopkg.in/check.v1"
 	"io/ioutil"
 	"log"
 	"testing"
+
+	"github.com/golang/groupcache"
+	. "gopkg.in/check.v1"
 )
 
 // Hook up gocheck into the "go test" runner.
@@ -15,6 +17,13 @@ func Test(t *testing.T) {
 func setUpSuite(c *C) {
 	// Silence the logger
 	log.SetOutput(ioutil.Discard)
+
+	// Suites share a single cache group since groupcache
+	// doesn't allow registering a name twice
+	if cache == nil {
+		cache = groupcache.NewGroup("TestImageProxyCache", 64<<20, groupcache.GetterFunc(getImage))
+		infoCache = groupcache.NewGroup("TestImageInfoCache", 8<<20, groupcache.GetterFunc(getInfo))
+	}
 }
 
 func setUpTest(c *C) {}
@@ -12,7 +12,7 @@ func TestRegion(t *testing.T) {
 	if region.Name == regionName {
 		t.Log("Region test passed")
 	} else {
-		t.Error("Region test failed: expected region %s recieved region %s", regionName, region.Name)
+		t.Errorf("Region test failed: expected region %s recieved region %s", regionName, region.Name)
 	}
 }
 
@@ -26,3 +26,42 @@ func TestRegionDefault(t *testing.T) {
 		t.Error("Default Region test failed: default region us-east-1 not returned")
 	}
 }
+
+func TestRegionCustomEndpoint(t *testing.T) {
+	defer os.Setenv("AWS_REGION", os.Getenv("AWS_REGION"))
+	os.Setenv("AWS_REGION", "minio-local")
+	os.Setenv("VIP_S3_ENDPOINT", "http://localhost:9000/")
+	defer os.Setenv("VIP_S3_ENDPOINT", "")
+
+	region := getRegion()
+	if region.Name != "minio-local" {
+		t.Errorf("Expected region minio-local; got %s", region.Name)
+	}
+	if region.S3Endpoint != "http://localhost:9000" {
+		t.Errorf("Expected endpoint http://localhost:9000; got %s", region.S3Endpoint)
+	}
+	if region.S3BucketEndpoint != "" {
+		t.Errorf("Expected path-style addressing; got %s", region.S3BucketEndpoint)
+	}
+
+	os.Setenv("VIP_S3_PATH_STYLE", "false")
+	defer os.Setenv("VIP_S3_PATH_STYLE", "")
+
+	region = getRegion()
+	if region.S3BucketEndpoint != "http://${bucket}.localhost:9000" {
+		t.Errorf("Expected a virtual-host bucket endpoint; got %s", region.S3BucketEndpoint)
+	}
+}
+
+func TestRegionInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"localhost:9000", "ftp://localhost", "http://"} {
+		if _, err := customRegion("", endpoint, true); err == nil {
+			t.Errorf("Expected an error for %q", endpoint)
+		}
+	}
+
+	region, err := customRegion("", "https://s3.example.com", true)
+	if err != nil || region.Name != "us-east-1" {
+		t.Errorf("Expected the default region name; got %q, %v", region.Name, err)
+	}
+}
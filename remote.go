@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vokal/vip/config"
+)
+
+type RemoteUpload struct {
+	Url string `json:"url"`
+}
+
+var (
+	remote      *http.Client
+	remoteAllow []*net.IPNet
+)
+
+var errDeniedAddress = errors.New("address is not allowed")
+
+// deniedNetworks are never fetched from unless allowlisted in
+// VIP_REMOTE_ALLOW, so uploads can't be used to reach internal
+// services.
+var deniedNetworks = parseNetworks([]string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/3",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+})
+
+// parseNetworks reads CIDR ranges or single IP addresses, skipping
+// anything it can't parse.
+func parseNetworks(settings []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, s := range settings {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip == nil {
+				continue
+			} else if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Printf("Ignoring invalid network %q\n", s)
+			continue
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func allowedAddress(ip net.IP, allow []*net.IPNet) bool {
+	for _, network := range allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	for _, network := range deniedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRemoteClient returns a client that checks every address it
+// connects to, after DNS resolution and on each redirect, so a
+// hostname can't be pointed at a denied address.
+func newRemoteClient(timeout time.Duration, allow []*net.IPNet) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil || !allowedAddress(ip, allow) {
+				return errDeniedAddress
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+				return fmt.Errorf("can't follow a redirect to %s", r.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// deniedError reports whether a request failed because it tried to
+// connect to a denied address.
+func deniedError(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*net.OpError); ok {
+		err = e.Err
+	}
+
+	return err == errDeniedAddress
+}
+
+func writeUploadError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Msg: msg})
+}
+
+// handleRemoteUpload downloads the image at a URL given in a JSON
+// body and stores it as if it had been uploaded directly.
+func handleRemoteUpload(w http.ResponseWriter, r *http.Request, b *config.Bucket, limit int64) {
+	var upload RemoteUpload
+	if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+		writeUploadError(w, http.StatusBadRequest, "The request body must be JSON with a url")
+		return
+	}
+
+	source, err := url.Parse(upload.Url)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		writeUploadError(w, http.StatusBadRequest, fmt.Sprintf("%q is not an http(s) URL", upload.Url))
+		return
+	}
+
+	resp, err := remote.Get(source.String())
+	if err != nil {
+		if deniedError(err) {
+			writeUploadError(w, http.StatusForbidden, "Images can't be downloaded from that address")
+			return
+		}
+		writeUploadError(w, http.StatusBadGateway, fmt.Sprintf("The image could not be downloaded: %s", err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		writeUploadError(w, http.StatusBadGateway, fmt.Sprintf("The image could not be downloaded: %s", resp.Status))
+		return
+	}
+
+	mime := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(mime, "image/") {
+		writeUploadError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Expected an image; got %q", mime))
+		return
+	}
+
+	tooLarge := fmt.Sprintf("The file size limit is %dMB", limit)
+	if resp.ContentLength > limit<<20 {
+		writeUploadError(w, http.StatusRequestEntityTooLarge, tooLarge)
+		return
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit<<20+1))
+	if err != nil {
+		writeUploadError(w, http.StatusBadGateway, fmt.Sprintf("The image could not be downloaded: %s", err.Error()))
+		return
+	} else if int64(len(raw)) > limit<<20 {
+		writeUploadError(w, http.StatusRequestEntityTooLarge, tooLarge)
+		return
+	} else if len(raw) == 0 {
+		writeUploadError(w, http.StatusBadRequest, "File must have size greater than 0")
+		return
+	}
+
+	response, status, err := storeUpload(r, b, bytes.NewReader(raw), mime)
+	if err != nil {
+		writeUploadError(w, status, err.Error())
+		return
+	}
+	log.Printf("Uploaded %s to %s from %s", response.Url, b.Name, source.Host)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
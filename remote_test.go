@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vokal/vip/test"
+	. "gopkg.in/check.v1"
+)
+
+var (
+	_ = Suite(&RemoteSuite{})
+)
+
+type RemoteSuite struct {
+	origin *httptest.Server
+}
+
+func (s *RemoteSuite) SetUpSuite(c *C) {
+	setUpSuite(c)
+
+	photo, err := ioutil.ReadFile("./test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	m := http.NewServeMux()
+	m.HandleFunc("/photo.jpg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(photo)
+	})
+	m.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	})
+	m.HandleFunc("/large.jpg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(bytes.Repeat([]byte{0}, 6<<20))
+	})
+	m.HandleFunc("/slow.jpg", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(photo)
+	})
+	m.Handle("/redirect", http.RedirectHandler("/photo.jpg", http.StatusFound))
+	s.origin = httptest.NewServer(m)
+}
+
+func (s *RemoteSuite) TearDownSuite(c *C) {
+	s.origin.Close()
+}
+
+func (s *RemoteSuite) SetUpTest(c *C) {
+	setUpTest(c)
+
+	authToken = "lalalatokenlalala"
+	storage = test.NewStore()
+
+	// The origin listens on loopback, which is denied by default
+	remote = newRemoteClient(time.Second, parseNetworks([]string{"127.0.0.1"}))
+}
+
+func (s *RemoteSuite) upload(c *C, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+
+	// Mock up a router so that mux.Vars are passed
+	// correctly
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/upload/samplebucket", strings.NewReader(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vip-Token", authToken)
+	m.ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+func (s *RemoteSuite) TestRemoteUpload(c *C) {
+	for _, path := range []string{"/photo.jpg", "/redirect"} {
+		recorder := s.upload(c, fmt.Sprintf(`{"url": "%s%s"}`, s.origin.URL, path))
+		c.Assert(recorder.Code, Equals, http.StatusCreated)
+
+		var u UploadResponse
+		c.Assert(json.NewDecoder(recorder.Body).Decode(&u), IsNil)
+		c.Check(u.Url, Matches, "http://localhost:8080/samplebucket/[0-9a-f]+-240x150")
+	}
+}
+
+func (s *RemoteSuite) TestRemoteUploadErrors(c *C) {
+	cases := map[string]int{
+		"not json":                             http.StatusBadRequest,
+		`{"url": "ftp://example.com/a.jpg"}`:   http.StatusBadRequest,
+		`{"url": "/photo.jpg"}`:                http.StatusBadRequest,
+		`{"url": "ORIGIN/page.html"}`:          http.StatusUnsupportedMediaType,
+		`{"url": "ORIGIN/missing.jpg"}`:        http.StatusBadGateway,
+		`{"url": "ORIGIN/large.jpg"}`:          http.StatusRequestEntityTooLarge,
+		`{"url": "ORIGIN/slow.jpg"}`:           http.StatusBadGateway,
+		`{"url": "http://10.0.0.1/photo.jpg"}`: http.StatusForbidden,
+	}
+
+	remote = newRemoteClient(100*time.Millisecond, parseNetworks([]string{"127.0.0.1"}))
+
+	for body, code := range cases {
+		recorder := s.upload(c, strings.Replace(body, "ORIGIN", s.origin.URL, 1))
+		c.Check(recorder.Code, Equals, code, Commentf(body))
+		c.Check(recorder.HeaderMap.Get("Content-Type"), Equals, "application/json", Commentf(body))
+	}
+}
+
+func (s *RemoteSuite) TestRemoteUploadDenied(c *C) {
+	remote = newRemoteClient(time.Second, nil)
+
+	// Loopback is denied, including through a hostname or redirect
+	host := strings.Replace(s.origin.URL, "127.0.0.1", "localhost", 1)
+	for _, source := range []string{s.origin.URL + "/photo.jpg", host + "/redirect"} {
+		recorder := s.upload(c, fmt.Sprintf(`{"url": "%s"}`, source))
+		c.Check(recorder.Code, Equals, http.StatusForbidden, Commentf(source))
+	}
+}
+
+func (s *RemoteSuite) TestAllowedAddress(c *C) {
+	allow := parseNetworks([]string{"10.1.0.0/16", "::1", "bogus", ""})
+	c.Assert(allow, HasLen, 2)
+
+	cases := map[string]bool{
+		"93.184.216.34":   true,
+		"2606:2800::1":    true,
+		"10.1.2.3":        true,
+		"10.2.0.1":        false,
+		"127.0.0.1":       false,
+		"169.254.169.254": false,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             true,
+		"fd00::1":         false,
+		"::ffff:10.2.0.1": false,
+	}
+
+	for address, allowed := range cases {
+		c.Check(allowedAddress(net.ParseIP(address), allow), Equals, allowed, Commentf(address))
+	}
+}
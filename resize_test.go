@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"image"
-	_ "image/gif"
+	"image/color"
+	"image/gif"
 	"image/jpeg"
-	_ "image/png"
+	"image/png"
 	"io/ioutil"
 
 	"github.com/vokal/vip/fetch"
@@ -211,6 +213,145 @@ func (s *ResizeSuite) TestResizeNoExifImage(c *C) {
 	}
 }
 
+func (s *ResizeSuite) TestResizeOrientedOriginal(c *C) {
+	// Every f*-exif.jpg is 40x80 once its orientation is applied
+	for i := 1; i <= 8; i++ {
+		file, err := ioutil.ReadFile(fmt.Sprintf("test/f%d-exif.jpg", i))
+		c.Assert(err, IsNil)
+
+		ctx := &fetch.CacheContext{
+			Width: 20,
+		}
+
+		resized, err := fetch.Resize(bytes.NewReader(file), ctx)
+		c.Assert(err, IsNil)
+
+		image, _, err := image.Decode(resized)
+		c.Assert(err, IsNil)
+		c.Check(image.Bounds().Size().X, Equals, 20, Commentf("f%d", i))
+		c.Check(image.Bounds().Size().Y, Equals, 40, Commentf("f%d", i))
+	}
+}
+
+func (s *ResizeSuite) TestResizeBox(c *C) {
+	file, err := ioutil.ReadFile("test/AWESOME.jpg")
+	c.Assert(err, IsNil)
+
+	boxes := []struct {
+		fit    fetch.Fit
+		width  int
+		height int
+		x, y   int
+	}{
+		{fetch.FitCover, 300, 200, 300, 200},
+		{fetch.FitContain, 300, 300, 300, 300},
+		{fetch.FitFill, 300, 300, 300, 300},
+		{fetch.FitInside, 300, 300, 300, 187},
+	}
+
+	for _, box := range boxes {
+		ctx := &fetch.CacheContext{
+			Width:  box.width,
+			Height: box.height,
+			Fit:    box.fit,
+		}
+
+		buf := bytes.NewReader(file)
+		resized, err := fetch.Resize(buf, ctx)
+		c.Check(err, IsNil)
+
+		image, _, err := image.Decode(resized)
+		c.Check(err, IsNil)
+		c.Check(image.Bounds().Size().X, Equals, box.x)
+		c.Check(image.Bounds().Size().Y, Equals, box.y)
+	}
+}
+
+func (s *ResizeSuite) TestResizeFillPNG(c *C) {
+	// Opaque on the left, transparent on the right
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			src.Set(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	buf := new(bytes.Buffer)
+	c.Assert(png.Encode(buf, src), IsNil)
+
+	ctx := &fetch.CacheContext{Width: 60, Height: 40, Fit: fetch.FitFill}
+	resized, err := fetch.Resize(bytes.NewReader(buf.Bytes()), ctx)
+	c.Assert(err, IsNil)
+
+	img, format, err := image.Decode(resized)
+	c.Assert(err, IsNil)
+	c.Assert(format, Equals, "png")
+	c.Check(img.Bounds().Size(), Equals, image.Pt(60, 40))
+
+	_, _, _, a := img.At(55, 20).RGBA()
+	c.Check(a, Equals, uint32(0))
+}
+
+func (s *ResizeSuite) TestResizeHeight(c *C) {
+	file, err := ioutil.ReadFile("test/AWESOME.jpg")
+	c.Assert(err, IsNil)
+
+	ctx := &fetch.CacheContext{
+		Height: 200,
+	}
+
+	buf := bytes.NewReader(file)
+	resized, err := fetch.Resize(buf, ctx)
+	c.Check(err, IsNil)
+
+	image, _, err := image.Decode(resized)
+	c.Check(err, IsNil)
+	c.Check(image.Bounds().Size().X, Equals, 320)
+	c.Check(image.Bounds().Size().Y, Equals, 200)
+}
+
+func (s *ResizeSuite) TestResizeOversizedBox(c *C) {
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	ctx := &fetch.CacheContext{
+		Width:  400,
+		Height: 200,
+		Fit:    fetch.FitCover,
+	}
+
+	buf := bytes.NewReader(file)
+	resized, err := fetch.Resize(buf, ctx)
+	c.Check(err, IsNil)
+
+	// The box keeps its 2:1 ratio but shrinks to fit the 240x150 source
+	image, _, err := image.Decode(resized)
+	c.Check(err, IsNil)
+	c.Check(image.Bounds().Size().X, Equals, 240)
+	c.Check(image.Bounds().Size().Y, Equals, 120)
+}
+
+func (s *ResizeSuite) TestResizeQuality(c *C) {
+	file, err := ioutil.ReadFile("test/awesome.jpeg")
+	c.Assert(err, IsNil)
+
+	sizes := make(map[int]int)
+	for _, quality := range []int{50, 95} {
+		ctx := &fetch.CacheContext{
+			Width:   500,
+			Quality: quality,
+		}
+
+		resized, err := fetch.Resize(bytes.NewReader(file), ctx)
+		c.Assert(err, IsNil)
+
+		data, err := ioutil.ReadAll(resized)
+		c.Assert(err, IsNil)
+		sizes[quality] = len(data)
+	}
+
+	c.Check(sizes[50] < sizes[95], Equals, true)
+}
+
 func (s *ResizeSuite) TestResizeStaticGif(c *C) {
 	file, err := ioutil.ReadFile("test/static.gif")
 	c.Assert(err, IsNil)
@@ -243,12 +384,112 @@ func (s *ResizeSuite) TestResizeAnimatedGif(c *C) {
 		resized, err := fetch.ResizeGif(buf, ctx)
 		c.Check(err, IsNil)
 
-		image, _, err := image.Decode(resized)
-		c.Check(err, IsNil)
-		c.Check(image.Bounds().Size().X, Equals, width)
+		g, err := gif.DecodeAll(resized)
+		c.Assert(err, IsNil)
+		c.Check(len(g.Image), Equals, 2)
+		c.Check(g.Config.Width, Equals, width)
+		for _, frame := range g.Image {
+			c.Check(frame.Bounds().Size().X, Equals, width)
+		}
+	}
+}
+
+func (s *ResizeSuite) TestResizeGravity(c *C) {
+	file, err := ioutil.ReadFile("test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	crop := func(ctx *fetch.CacheContext) image.Image {
+		resized, err := fetch.Resize(bytes.NewReader(file), ctx)
+		c.Assert(err, IsNil)
+
+		img, _, err := image.Decode(resized)
+		c.Assert(err, IsNil)
+		c.Check(img.Bounds().Size(), Equals, image.Pt(100, 100))
+		return img
+	}
+
+	// The mean difference between two crops, out of 0xffff
+	difference := func(a, b image.Image) uint32 {
+		var total uint32
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 100; x++ {
+				ag, _, _, _ := a.At(x, y).RGBA()
+				bg, _, _, _ := b.At(x, y).RGBA()
+				if ag > bg {
+					total += ag - bg
+				} else {
+					total += bg - ag
+				}
+			}
+		}
+		return total / 10000
+	}
+
+	// vips crops to the sides itself and Go to the corners, but the
+	// 240x150 source is square-cropped from its full height either way
+	west := crop(&fetch.CacheContext{Width: 100, Crop: true, Gravity: fetch.GravityWest})
+	northWest := crop(&fetch.CacheContext{Width: 100, Crop: true, Gravity: fetch.GravityNorthWest})
+	focal := crop(&fetch.CacheContext{Width: 100, Crop: true, Focal: &fetch.FocalPoint{X: 0, Y: 0.5}})
+	east := crop(&fetch.CacheContext{Width: 100, Crop: true, Gravity: fetch.GravityEast})
+	center := crop(&fetch.CacheContext{Width: 100, Crop: true})
+
+	c.Check(difference(west, northWest) < 0x800, Equals, true)
+	c.Check(difference(west, focal) < 0x800, Equals, true)
+	c.Check(difference(west, east) > 0x1000, Equals, true)
+	c.Check(difference(center, east) > 0x1000, Equals, true)
+}
+
+func (s *ResizeSuite) TestResizeAnimatedGifBox(c *C) {
+	file, err := ioutil.ReadFile("test/animated.gif")
+	c.Assert(err, IsNil)
+
+	// The source is 1024x640
+	for _, t := range []struct {
+		ctx           fetch.CacheContext
+		width, height int
+	}{
+		{fetch.CacheContext{Width: 200, Crop: true}, 200, 200},
+		{fetch.CacheContext{Height: 320}, 512, 320},
+		{fetch.CacheContext{Width: 300, Height: 200, Fit: fetch.FitCover}, 300, 200},
+		{fetch.CacheContext{Width: 300, Height: 300, Fit: fetch.FitContain}, 300, 300},
+		{fetch.CacheContext{Width: 300, Height: 300, Fit: fetch.FitInside}, 300, 187},
+		{fetch.CacheContext{Width: 300, Height: 300, Fit: fetch.FitFill}, 300, 300},
+		{fetch.CacheContext{Rect: &fetch.Rect{X: 100, Y: 100, Width: 512, Height: 320}}, 512, 320},
+		{fetch.CacheContext{Width: 256, Rect: &fetch.Rect{Width: 50, Height: 100, Percent: true}}, 256, 320},
+	} {
+		resized, err := fetch.ResizeGif(bytes.NewReader(file), &t.ctx)
+		c.Assert(err, IsNil)
+
+		g, err := gif.DecodeAll(resized)
+		c.Assert(err, IsNil)
+		c.Check(len(g.Image), Equals, 2)
+		for _, frame := range g.Image {
+			c.Check(frame.Bounds().Size(), Equals, image.Pt(t.width, t.height))
+		}
 	}
 }
 
+func (s *ResizeSuite) TestAnimatedGifKeepsFormat(c *C) {
+	file, err := ioutil.ReadFile("test/animated.gif")
+	c.Assert(err, IsNil)
+	err = storage.Put("samplebucket", "animated", file, "image/gif")
+	c.Assert(err, IsNil)
+
+	ctx := &fetch.CacheContext{
+		ImageId: "animated",
+		Bucket:  "samplebucket",
+		Width:   160,
+		Format:  fetch.FormatWebP,
+	}
+
+	data, err := fetch.ImageData(storage, ctx)
+	c.Assert(err, IsNil)
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	c.Check(len(g.Image), Equals, 2)
+}
+
 func (s *ResizeSuite) insertMockImage() (*fetch.CacheContext, error) {
 	file, err := ioutil.ReadFile("test/exif_test_img.jpg")
 	if err != nil {
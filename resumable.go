@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vokal/vip/config"
+	"github.com/vokal/vip/store"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads are kept in the bucket they're for, under a prefix
+// no image key can start with, as a session record plus one object
+// per chunk named by its offset and length.
+const resumablePrefix = "_resumable"
+
+var uploadExpiry time.Duration
+
+// uploadKey reports whether an image ID names resumable uploads, which
+// image requests and deletes must never reach.
+func uploadKey(id string) bool {
+	return strings.HasPrefix(id, resumablePrefix)
+}
+
+type uploadSession struct {
+	Length  int64     `json:"length"`
+	Expires time.Time `json:"expires"`
+}
+
+type uploadChunk struct {
+	key            string
+	offset, length int64
+}
+
+// uploadBuckets remembers which buckets have had sessions so expired
+// ones can be swept when there's no bucket configuration to list.
+var uploadBuckets = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+func sessionPrefix(id string) string {
+	return fmt.Sprintf("%s/%s/", resumablePrefix, id)
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func loadSession(bucket, id string) (*uploadSession, error) {
+	r, err := storage.GetReader(bucket, sessionPrefix(id)+"session")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	session := &uploadSession{}
+	if err := json.NewDecoder(r).Decode(session); err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(session.Expires) {
+		removeSession(bucket, id)
+		return nil, &store.Error{Kind: store.ErrNotFound, Err: fmt.Errorf("upload %s has expired", id)}
+	}
+
+	return session, nil
+}
+
+// uploadChunks returns the chunks that make up the upload so far, in
+// order, and the offset they reach.
+func uploadChunks(bucket, id string) ([]uploadChunk, int64, error) {
+	keys, err := storage.List(bucket, sessionPrefix(id))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var stored []uploadChunk
+	for _, key := range keys {
+		var c uploadChunk
+		name := strings.TrimPrefix(key, sessionPrefix(id))
+		if _, err := fmt.Sscanf(name, "%d-%d", &c.offset, &c.length); err != nil {
+			continue
+		}
+		c.key = key
+		stored = append(stored, c)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].offset < stored[j].offset })
+
+	// Only the chunks that follow on from each other count
+	var chunks []uploadChunk
+	var offset int64
+	for _, c := range stored {
+		if c.offset == offset {
+			chunks = append(chunks, c)
+			offset += c.length
+		}
+	}
+
+	return chunks, offset, nil
+}
+
+func removeSession(bucket, id string) error {
+	keys, err := storage.List(bucket, sessionPrefix(id))
+	if err != nil {
+		return err
+	}
+
+	// Remove the session record last so a failure can be retried
+	session := sessionPrefix(id) + "session"
+	for _, key := range keys {
+		if key != session {
+			if err := storage.Delete(bucket, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return storage.Delete(bucket, session)
+}
+
+// sweepUploads removes expired sessions from every configured bucket,
+// whichever node created them. Without a bucket configuration only the
+// buckets this node has created sessions in are known.
+func sweepUploads() {
+	buckets, ok := config.Names()
+	if !ok {
+		uploadBuckets.Lock()
+		for name := range uploadBuckets.names {
+			buckets = append(buckets, name)
+		}
+		uploadBuckets.Unlock()
+	}
+
+	for _, bucket := range buckets {
+		keys, err := storage.List(bucket, resumablePrefix+"/")
+		if err != nil {
+			log.Printf("Listing uploads in %s failed: %s", bucket, err.Error())
+			continue
+		}
+
+		for _, key := range keys {
+			parts := strings.Split(key, "/")
+			if len(parts) == 3 && parts[2] == "session" {
+				// Loading an expired session removes it
+				loadSession(bucket, parts[1])
+			}
+		}
+	}
+}
+
+func setUploadHeaders(w http.ResponseWriter, session *uploadSession, offset int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	w.Header().Set("Upload-Expires", session.Expires.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// handleCreateUpload starts a resumable upload of Upload-Length bytes.
+func handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, ok := requestBucket(w, r)
+	if !ok {
+		return
+	}
+
+	limit := sizeLimit(b)
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeUploadError(w, http.StatusBadRequest, "Upload-Length must be a size greater than 0")
+		return
+	} else if length > limit<<20 {
+		writeUploadError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("The file size limit is %dMB", limit))
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	session := &uploadSession{Length: length, Expires: time.Now().Add(uploadExpiry)}
+	data, err := json.Marshal(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := storage.Put(b.Name, sessionPrefix(id)+"session", data, "application/json"); err != nil {
+		code, _ := errorStatus(err)
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	uploadBuckets.Lock()
+	uploadBuckets.names[b.Name] = true
+	uploadBuckets.Unlock()
+
+	setUploadHeaders(w, session, 0)
+	w.Header().Set("Location", fmt.Sprintf("/upload/%s/resumable/%s", b.Name, id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleResumableUpload reports on (HEAD), appends to (PATCH),
+// completes (POST) or cancels (DELETE) a resumable upload.
+func handleResumableUpload(w http.ResponseWriter, r *http.Request) {
+	b, ok := requestBucket(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["upload_id"]
+	if !validUploadID(id) {
+		writeUploadError(w, http.StatusNotFound, "Upload not found")
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if err := removeSession(b.Name, id); err != nil {
+			code, _ := errorStatus(err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	session, err := loadSession(b.Name, id)
+	if err != nil {
+		code, msg := errorStatus(err)
+		if code == http.StatusNotFound {
+			msg = "Upload not found"
+		}
+		writeUploadError(w, code, msg)
+		return
+	}
+
+	chunks, offset, err := uploadChunks(b.Name, id)
+	if err != nil {
+		code, msg := errorStatus(err)
+		writeUploadError(w, code, msg)
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		setUploadHeaders(w, session, offset)
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		appendChunk(w, r, b, id, session, offset)
+	case "POST":
+		finishUpload(w, r, b, id, session, chunks, offset)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// appendChunk stores the request body as the next chunk. A chunk is
+// only kept once it has been received in full, so a client whose
+// connection drops asks for the offset with HEAD and sends it again.
+func appendChunk(w http.ResponseWriter, r *http.Request, b *config.Bucket, id string, session *uploadSession, offset int64) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeUploadError(w, http.StatusUnsupportedMediaType, "Chunks must be sent as application/offset+octet-stream")
+		return
+	}
+
+	start, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeUploadError(w, http.StatusBadRequest, "Upload-Offset must be set")
+		return
+	} else if start != offset {
+		setUploadHeaders(w, session, offset)
+		writeUploadError(w, http.StatusConflict, fmt.Sprintf("Expected a chunk at offset %d", offset))
+		return
+	}
+
+	remaining := session.Length - offset
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, remaining+1))
+	if err != nil {
+		writeUploadError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if int64(len(data)) > remaining {
+		writeUploadError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Only %d bytes remain", remaining))
+		return
+	}
+
+	if len(data) > 0 {
+		key := fmt.Sprintf("%s%020d-%d", sessionPrefix(id), offset, len(data))
+		if err := storage.Put(b.Name, key, data, "application/octet-stream"); err != nil {
+			code, _ := errorStatus(err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+	}
+
+	setUploadHeaders(w, session, offset+int64(len(data)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload assembles a complete upload and stores it as if it had
+// been uploaded in one request.
+func finishUpload(w http.ResponseWriter, r *http.Request, b *config.Bucket, id string, session *uploadSession, chunks []uploadChunk, offset int64) {
+	if offset != session.Length {
+		setUploadHeaders(w, session, offset)
+		writeUploadError(w, http.StatusConflict, fmt.Sprintf("Only %d of %d bytes have been uploaded", offset, session.Length))
+		return
+	}
+
+	readers := make([]io.Reader, 0, len(chunks))
+	for _, c := range chunks {
+		chunk, err := storage.GetReader(b.Name, c.key)
+		if err != nil {
+			code, _ := errorStatus(err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		defer chunk.Close()
+		readers = append(readers, chunk)
+	}
+
+	response, status, err := storeUpload(r, b, io.MultiReader(readers...), "")
+	if err != nil {
+		writeUploadError(w, status, err.Error())
+		return
+	}
+
+	if err := removeSession(b.Name, id); err != nil {
+		log.Printf("Removing upload %s from %s failed: %s", id, b.Name, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vokal/vip/config"
+	"github.com/vokal/vip/test"
+	. "gopkg.in/check.v1"
+)
+
+var (
+	_ = Suite(&ResumableSuite{})
+)
+
+type ResumableSuite struct{}
+
+func (s *ResumableSuite) SetUpSuite(c *C) {
+	setUpSuite(c)
+}
+
+func (s *ResumableSuite) SetUpTest(c *C) {
+	setUpTest(c)
+
+	authToken = "lalalatokenlalala"
+	storage = test.NewStore()
+}
+
+func (s *ResumableSuite) request(c *C, method, uri string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+
+	// Mock up a router so that mux.Vars are passed
+	// correctly
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}/resumable", verifyAuth(handleCreateUpload))
+	m.Handle("/upload/{bucket_id}/resumable/{upload_id}", verifyAuth(handleResumableUpload))
+
+	req, err := http.NewRequest(method, "http://localhost:8080"+uri, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Vip-Token", authToken)
+	m.ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+func (s *ResumableSuite) create(c *C, length int) string {
+	header := http.Header{"Upload-Length": {strconv.Itoa(length)}}
+	recorder := s.request(c, "POST", "/upload/samplebucket/resumable", nil, header)
+	c.Assert(recorder.Code, Equals, http.StatusCreated)
+	c.Assert(recorder.HeaderMap.Get("Upload-Offset"), Equals, "0")
+
+	location := recorder.HeaderMap.Get("Location")
+	c.Assert(location, Matches, "/upload/samplebucket/resumable/[0-9a-f]{32}")
+	return location
+}
+
+func (s *ResumableSuite) patch(c *C, location string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	header := http.Header{
+		"Content-Type":  {"application/offset+octet-stream"},
+		"Upload-Offset": {strconv.Itoa(offset)},
+	}
+	return s.request(c, "PATCH", location, chunk, header)
+}
+
+func (s *ResumableSuite) TestResumableUpload(c *C) {
+	file, err := ioutil.ReadFile("./test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	location := s.create(c, len(file))
+	third := len(file) / 3
+
+	recorder := s.patch(c, location, 0, file[:third])
+	c.Assert(recorder.Code, Equals, http.StatusNoContent)
+	c.Assert(recorder.HeaderMap.Get("Upload-Offset"), Equals, strconv.Itoa(third))
+
+	// A chunk at the wrong offset is refused with the right one
+	recorder = s.patch(c, location, 0, file[:third])
+	c.Assert(recorder.Code, Equals, http.StatusConflict)
+	c.Assert(recorder.HeaderMap.Get("Upload-Offset"), Equals, strconv.Itoa(third))
+
+	recorder = s.request(c, "PATCH", location, file[third:], http.Header{"Upload-Offset": {strconv.Itoa(third)}})
+	c.Assert(recorder.Code, Equals, http.StatusUnsupportedMediaType)
+
+	// Finishing early tells the client how far it got
+	recorder = s.request(c, "POST", location, nil, nil)
+	c.Assert(recorder.Code, Equals, http.StatusConflict)
+
+	// A client resuming asks where to carry on from
+	recorder = s.request(c, "HEAD", location, nil, nil)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.HeaderMap.Get("Upload-Offset"), Equals, strconv.Itoa(third))
+	c.Assert(recorder.HeaderMap.Get("Upload-Length"), Equals, strconv.Itoa(len(file)))
+
+	recorder = s.patch(c, location, third, append(file[third:], 0))
+	c.Assert(recorder.Code, Equals, http.StatusRequestEntityTooLarge)
+
+	recorder = s.patch(c, location, third, file[third:])
+	c.Assert(recorder.Code, Equals, http.StatusNoContent)
+	c.Assert(recorder.HeaderMap.Get("Upload-Offset"), Equals, strconv.Itoa(len(file)))
+
+	recorder = s.request(c, "POST", location, nil, http.Header{"X-Vip-Warmup": {"s=100"}})
+	c.Assert(recorder.Code, Equals, http.StatusCreated)
+
+	var u UploadResponse
+	c.Assert(json.NewDecoder(recorder.Body).Decode(&u), IsNil)
+	c.Assert(u.Url, Matches, "http://localhost:8080/samplebucket/[0-9a-f]+-240x150")
+	c.Assert(u.Variants, HasLen, 1)
+
+	// The session is cleaned up once the image is stored
+	keys, err := storage.List("samplebucket", resumablePrefix+"/")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+
+	recorder = s.request(c, "HEAD", location, nil, nil)
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+}
+
+func (s *ResumableSuite) TestCreateUploadLimits(c *C) {
+	for length, code := range map[string]int{
+		"":        http.StatusBadRequest,
+		"0":       http.StatusBadRequest,
+		"lots":    http.StatusBadRequest,
+		"1048576": http.StatusCreated,
+		"9999999": http.StatusRequestEntityTooLarge,
+	} {
+		recorder := s.request(c, "POST", "/upload/samplebucket/resumable", nil, http.Header{"Upload-Length": {length}})
+		c.Check(recorder.Code, Equals, code, Commentf(length))
+	}
+
+	recorder := s.request(c, "HEAD", "/upload/samplebucket/resumable/notanid", nil, nil)
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+}
+
+func (s *ResumableSuite) TestCancelUpload(c *C) {
+	location := s.create(c, 100)
+	c.Assert(s.patch(c, location, 0, make([]byte, 50)).Code, Equals, http.StatusNoContent)
+
+	recorder := s.request(c, "DELETE", location, nil, nil)
+	c.Assert(recorder.Code, Equals, http.StatusNoContent)
+
+	keys, err := storage.List("samplebucket", resumablePrefix+"/")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+
+	recorder = s.request(c, "HEAD", location, nil, nil)
+	c.Assert(recorder.Code, Equals, http.StatusNotFound)
+}
+
+func (s *ResumableSuite) TestUploadExpiry(c *C) {
+	defer func(d time.Duration) { uploadExpiry = d }(uploadExpiry)
+
+	uploadExpiry = time.Hour
+	live := s.create(c, 100)
+
+	uploadExpiry = -time.Second
+	expired := s.create(c, 100)
+	s.patch(c, expired, 0, make([]byte, 50))
+
+	sweepUploads()
+
+	keys, err := storage.List("samplebucket", resumablePrefix+"/")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+
+	c.Assert(s.request(c, "HEAD", live, nil, nil).Code, Equals, http.StatusOK)
+	c.Assert(s.request(c, "HEAD", expired, nil, nil).Code, Equals, http.StatusNotFound)
+}
+
+func (s *ResumableSuite) TestSweepConfiguredBuckets(c *C) {
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+	defer config.Set(nil)
+
+	// Sessions another node created in a bucket this one hasn't seen
+	for id, expires := range map[string]time.Time{
+		"0123456789abcdef0123456789abcdef": time.Now().Add(time.Hour),
+		"fedcba9876543210fedcba9876543210": time.Now().Add(-time.Second),
+	} {
+		data, err := json.Marshal(&uploadSession{Length: 100, Expires: expires})
+		c.Assert(err, IsNil)
+		c.Assert(storage.Put("places", sessionPrefix(id)+"session", data, "application/json"), IsNil)
+	}
+
+	sweepUploads()
+
+	keys, err := storage.List("places", resumablePrefix+"/")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{sessionPrefix("0123456789abcdef0123456789abcdef") + "session"})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/url"
+
+	. "gopkg.in/check.v1"
+)
+
+var (
+	_ = Suite(&SignSuite{})
+)
+
+type SignSuite struct{}
+
+func (s *SignSuite) SetUpSuite(c *C) {
+	setUpSuite(c)
+}
+
+func (s *SignSuite) SetUpTest(c *C) {
+	setUpTest(c)
+
+	signingKey = "globalsecret"
+	bucketSigningKeys = parseSigningKeys("private:bucketsecret,broken,:nobucket")
+}
+
+func (s *SignSuite) TearDownTest(c *C) {
+	signingKey = ""
+	bucketSigningKeys = nil
+}
+
+func (s *SignSuite) TestParseSigningKeys(c *C) {
+	c.Assert(bucketSigningKeys, DeepEquals, map[string]string{"private": "bucketsecret"})
+}
+
+func (s *SignSuite) TestSignAndVerify(c *C) {
+	query, err := url.ParseQuery(signQuery("public", "/public/abc", "s=200&c=true"))
+	c.Assert(err, IsNil)
+	c.Assert(query.Get(signatureParam), Not(Equals), "")
+	c.Assert(verifySignature("public", "/public/abc", query), Equals, true)
+
+	// Parameter order doesn't matter
+	reordered, err := url.ParseQuery("c=true&s=200&sig=" + query.Get(signatureParam))
+	c.Assert(err, IsNil)
+	c.Assert(verifySignature("public", "/public/abc", reordered), Equals, true)
+
+	// Tampering with the parameters or path invalidates the signature
+	query.Set("s", "201")
+	c.Assert(verifySignature("public", "/public/abc", query), Equals, false)
+	query.Set("s", "200")
+	c.Assert(verifySignature("public", "/public/abd", query), Equals, false)
+
+	query.Del(signatureParam)
+	c.Assert(verifySignature("public", "/public/abc", query), Equals, false)
+}
+
+func (s *SignSuite) TestBucketKey(c *C) {
+	query, err := url.ParseQuery(signQuery("private", "/private/abc", "s=200"))
+	c.Assert(err, IsNil)
+	c.Assert(verifySignature("private", "/private/abc", query), Equals, true)
+
+	// The global key doesn't validate for a bucket with its own key
+	query.Set(signatureParam, signature(signingKey, "/private/abc", query))
+	c.Assert(verifySignature("private", "/private/abc", query), Equals, false)
+}
+
+func (s *SignSuite) TestSigningDisabled(c *C) {
+	signingKey = ""
+	bucketSigningKeys = nil
+
+	c.Assert(signQuery("public", "/public/abc", "s=200"), Equals, "s=200")
+	c.Assert(verifySignature("public", "/public/abc", url.Values{}), Equals, true)
+}
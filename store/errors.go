@@ -0,0 +1,80 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+// The kinds of failure an ImageStore reports, so callers can tell a
+// missing image from an unreachable backend without knowing which
+// store they're talking to.
+var (
+	ErrNotFound    = errors.New("image not found")
+	ErrForbidden   = errors.New("access denied")
+	ErrUnavailable = errors.New("storage unavailable")
+	ErrBadResponse = errors.New("bad response from storage")
+)
+
+// Error wraps the underlying failure with its kind.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// KindOf returns the kind of a storage error, or nil if err isn't one.
+func KindOf(err error) error {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+
+	return nil
+}
+
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	kind := ErrBadResponse
+	switch e := err.(type) {
+	case *s3.Error:
+		switch {
+		case e.StatusCode == 404 || e.Code == "NoSuchKey" || e.Code == "NoSuchBucket":
+			kind = ErrNotFound
+		case e.StatusCode == 403:
+			kind = ErrForbidden
+		case e.StatusCode == 503:
+			kind = ErrUnavailable
+		}
+	case net.Error:
+		kind = ErrUnavailable
+	default:
+		if err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		kind = ErrUnavailable
+	}
+
+	return &Error{kind, err}
+}
+
+func fileError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrInvalidKey || os.IsNotExist(err):
+		return &Error{ErrNotFound, err}
+	case os.IsPermission(err):
+		return &Error{ErrForbidden, err}
+	}
+
+	return err
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Keys are grouped into a directory per image ID, their first path
+// segment, so listing an image's derivatives only reads its own
+// directory. Content types are kept in a sidecar directory next to the
+// files; neither it nor temp files can collide with a key since keys
+// may not start with a dot.
+const metaDir = ".meta"
+
+var ErrInvalidKey = errors.New("invalid bucket or key")
+
+type FileStore struct {
+	root string
+}
+
+func NewFileStore(root string) *FileStore {
+	return &FileStore{root}
+}
+
+// paths maps a bucket and key to the image file and its content type
+// sidecar. Keys are escaped into a single file name so derivatives
+// like "{id}/s/200" can't collide with the "{id}" original.
+func (s *FileStore) paths(bucket, path string) (string, string, error) {
+	if !validBucket(bucket) || !validName(path) {
+		return "", "", ErrInvalidKey
+	}
+
+	id := strings.SplitN(path, "/", 2)[0]
+	if !validName(id) {
+		return "", "", ErrInvalidKey
+	}
+
+	dir := filepath.Join(s.root, bucket, url.QueryEscape(id))
+	name := url.QueryEscape(path)
+
+	return filepath.Join(dir, name), filepath.Join(dir, metaDir, name), nil
+}
+
+func validBucket(bucket string) bool {
+	return validName(bucket) && !strings.ContainsAny(bucket, `/\`)
+}
+
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".")
+}
+
+// writeFile replaces a file atomically by writing to a temp file in
+// the same directory and renaming it over the target.
+func writeFile(name string, data io.Reader) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func (s *FileStore) GetReader(bucket, path string) (io.ReadCloser, error) {
+	name, _, err := s.paths(bucket, path)
+	if err != nil {
+		return nil, fileError(err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fileError(err)
+	}
+
+	return f, nil
+}
+
+func (s *FileStore) PutReader(bucket, path string, data io.Reader, length int64, content string) error {
+	name, meta, err := s.paths(bucket, path)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(meta, strings.NewReader(content)); err != nil {
+		return fileError(err)
+	}
+
+	return fileError(writeFile(name, data))
+}
+
+func (s *FileStore) Put(bucket, path string, data []byte, content string) error {
+	return s.PutReader(bucket, path, bytes.NewReader(data), int64(len(data)), content)
+}
+
+func (s *FileStore) Head(bucket, path string) (*http.Response, error) {
+	name, meta, err := s.paths(bucket, path)
+	if err != nil {
+		return nil, fileError(err)
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, fileError(err)
+	}
+
+	content, err := ioutil.ReadFile(meta)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fileError(err)
+	}
+	if len(content) == 0 {
+		content = []byte("application/octet-stream")
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", string(content))
+	header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader("")),
+		ContentLength: info.Size(),
+	}, nil
+}
+
+func (s *FileStore) Delete(bucket, path string) error {
+	name, meta, err := s.paths(bucket, path)
+	if err != nil {
+		return err
+	}
+
+	// Deleting a missing key succeeds, as it does on S3
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return fileError(err)
+	}
+	if err := os.Remove(meta); err != nil && !os.IsNotExist(err) {
+		return fileError(err)
+	}
+
+	// Directories are only removed once they're empty, so this fails
+	// harmlessly while any other key for the image remains
+	os.Remove(filepath.Dir(meta))
+	os.Remove(filepath.Dir(name))
+
+	return nil
+}
+
+func (s *FileStore) List(bucket, prefix string) ([]string, error) {
+	if !validBucket(bucket) {
+		return nil, ErrInvalidKey
+	}
+
+	// A prefix naming an image only needs that image's directory;
+	// otherwise every directory the prefix could match is read
+	var dirs []string
+	if i := strings.Index(prefix, "/"); i >= 0 {
+		dirs = []string{url.QueryEscape(prefix[:i])}
+	} else {
+		files, err := ioutil.ReadDir(filepath.Join(s.root, bucket))
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, fileError(err)
+		}
+
+		for _, f := range files {
+			id, err := url.QueryUnescape(f.Name())
+			if err == nil && f.IsDir() && validName(f.Name()) && strings.HasPrefix(id, prefix) {
+				dirs = append(dirs, f.Name())
+			}
+		}
+	}
+
+	var keys []string
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(filepath.Join(s.root, bucket, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fileError(err)
+		}
+
+		for _, f := range files {
+			if f.IsDir() || !validName(f.Name()) {
+				continue
+			}
+
+			key, err := url.QueryUnescape(f.Name())
+			if err != nil || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
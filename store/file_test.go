@@ -0,0 +1,257 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func tempStore(t *testing.T) (*FileStore, func()) {
+	root, err := ioutil.TempDir("", "vip-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewFileStore(root), func() { os.RemoveAll(root) }
+}
+
+func TestFileStorePutGet(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	original := []byte("original image")
+	derivative := []byte("resized image")
+
+	if err := s.Put("bucket", "abc", original, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Derivatives live under the original's key
+	err := s.PutReader("bucket", "abc/s/200", bytes.NewReader(derivative), int64(len(derivative)), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string][]byte{"abc": original, "abc/s/200": derivative} {
+		r, err := s.GetReader("bucket", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("%s: expected %q; got %q", key, expected, data)
+		}
+	}
+
+	// Overwrites replace the file
+	if err := s.Put("bucket", "abc", derivative, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.GetReader("bucket", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(data, derivative) {
+		t.Errorf("Expected %q; got %q", derivative, data)
+	}
+
+	// No temp files are left behind
+	files, err := filepath.Glob(filepath.Join(s.root, "bucket", "*", ".tmp-*"))
+	if err != nil || len(files) != 0 {
+		t.Errorf("Unexpected temp files: %v", files)
+	}
+}
+
+func TestFileStoreHead(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	if err := s.Put("bucket", "abc", []byte("12345"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.Head("bucket", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected 200; got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Expected image/png; got %s", ct)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "5" {
+		t.Errorf("Expected 5; got %s", cl)
+	}
+	if resp.Header.Get("Last-Modified") == "" {
+		t.Error("Expected a Last-Modified header")
+	}
+}
+
+func TestFileStoreMissing(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	if _, err := s.GetReader("bucket", "missing"); KindOf(err) != ErrNotFound {
+		t.Errorf("Expected a not found error; got %v", err)
+	}
+	if _, err := s.Head("bucket", "missing"); KindOf(err) != ErrNotFound {
+		t.Errorf("Expected a not found error; got %v", err)
+	}
+	if _, err := s.GetReader("bucket", ".meta"); KindOf(err) != ErrNotFound {
+		t.Errorf("Expected a not found error; got %v", err)
+	}
+}
+
+func TestFileStoreInvalidKeys(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	cases := [][2]string{
+		{"bucket", ""},
+		{"bucket", ".."},
+		{"bucket", ".meta"},
+		{"..", "abc"},
+		{"a/b", "abc"},
+		{"", "abc"},
+	}
+
+	for _, c := range cases {
+		if err := s.Put(c[0], c[1], []byte("data"), "image/png"); err != ErrInvalidKey {
+			t.Errorf("%q/%q: expected ErrInvalidKey; got %v", c[0], c[1], err)
+		}
+	}
+
+	// Slashes and traversal inside a key stay within the bucket
+	if err := s.Put("bucket", "../../escape", []byte("data"), "image/png"); err != ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey; got %v", err)
+	}
+	if err := s.Put("bucket", "abc/../../escape", []byte("data"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "escape")); !os.IsNotExist(err) {
+		t.Error("Expected key to stay inside the bucket directory")
+	}
+}
+
+func TestFileStoreConcurrentPut(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte(fmt.Sprintf("%02d", i)), 4096)
+			if err := s.Put("bucket", "abc", data, "image/jpeg"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Whichever write won, the file is never a mix of two writes
+	r, err := s.GetReader("bucket", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+
+	if len(data) != 8192 || !bytes.Equal(data, bytes.Repeat(data[:2], 4096)) {
+		t.Error("Expected a complete, unmixed write")
+	}
+}
+
+func TestFileStoreDeleteList(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	for _, key := range []string{"abc", "abc/s/200", "abc/c/s/100", "abcd", "xyz/s/200"} {
+		if err := s.Put("bucket", key, []byte(key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := s.List("bucket", "abc/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"abc/c/s/100", "abc/s/200"}) {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	for _, key := range append(keys, "abc") {
+		if err := s.Delete("bucket", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err = s.List("bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"abcd", "xyz/s/200"}) {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	if _, err := s.Head("bucket", "abc"); KindOf(err) != ErrNotFound {
+		t.Errorf("Expected a not found error; got %v", err)
+	}
+
+	// An image's directory goes once the last of its keys does
+	if _, err := os.Stat(filepath.Join(s.root, "bucket", "abc")); !os.IsNotExist(err) {
+		t.Errorf("Expected the image directory to be removed; got %v", err)
+	}
+
+	// Deleting a missing key and listing a missing bucket both succeed
+	if err := s.Delete("bucket", "abc"); err != nil {
+		t.Error(err)
+	}
+	if keys, err := s.List("nobucket", ""); err != nil || len(keys) != 0 {
+		t.Errorf("Expected no keys; got %v, %v", keys, err)
+	}
+}
+
+func TestFileStoreLayout(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	for _, key := range []string{"abc", "abc/s/200", "xyz"} {
+		if err := s.Put("bucket", key, []byte(key), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Keys are grouped by image, so listing an image's keys only reads
+	// its own directory
+	if _, err := os.Stat(filepath.Join(s.root, "bucket", "abc", "abc%2Fs%2F200")); err != nil {
+		t.Errorf("Expected the derivative in its image's directory: %v", err)
+	}
+
+	keys, err := s.List("bucket", "abc/")
+	if err != nil || !reflect.DeepEqual(keys, []string{"abc/s/200"}) {
+		t.Errorf("Unexpected keys: %v, %v", keys, err)
+	}
+
+	if keys, err := s.List("bucket", "missing/"); err != nil || len(keys) != 0 {
+		t.Errorf("Expected no keys; got %v, %v", keys, err)
+	}
+}
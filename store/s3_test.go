@@ -0,0 +1,92 @@
+package store_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/vokal/vip/store"
+	"github.com/vokal/vip/test"
+)
+
+func TestS3StoreCustomEndpoint(t *testing.T) {
+	server := test.NewS3Server()
+	defer server.Close()
+
+	// The stand-in server only understands path-style addressing
+	region := aws.Region{
+		Name:       "minio-local",
+		S3Endpoint: server.URL,
+	}
+	auth := aws.Auth{AccessKey: "access", SecretKey: "secret"}
+	s := store.NewS3Store(s3.New(auth, region))
+
+	data := []byte("image data")
+	if err := s.Put("bucket", "abc", data, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutReader("bucket", "abc/s/200", bytes.NewReader(data), int64(len(data)), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.GetReader("bucket", "abc/s/200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected %q; got %q (%v)", data, got, err)
+	}
+
+	resp, err := s.Head("bucket", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Expected image/png; got %s", ct)
+	}
+
+	if _, err := s.GetReader("bucket", "missing"); store.KindOf(err) != store.ErrNotFound {
+		t.Errorf("Expected a not found error; got %v", err)
+	}
+	if _, err := s.Head("bucket", "missing"); store.KindOf(err) != store.ErrNotFound {
+		t.Errorf("Expected a not found error; got %v", err)
+	}
+
+	keys, err := s.List("bucket", "abc/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "abc/s/200" {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	if err := s.Delete("bucket", "abc/s/200"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetReader("bucket", "abc/s/200"); store.KindOf(err) != store.ErrNotFound {
+		t.Errorf("Expected a not found error; got %v", err)
+	}
+}
+
+func TestS3StoreErrors(t *testing.T) {
+	server := test.NewS3Server()
+	defer server.Close()
+
+	region := aws.Region{Name: "minio-local", S3Endpoint: server.URL}
+
+	// The stand-in server rejects requests without credentials
+	s := store.NewS3Store(s3.New(aws.Auth{}, region))
+	if _, err := s.GetReader("bucket", "abc"); store.KindOf(err) != store.ErrForbidden {
+		t.Errorf("Expected a forbidden error; got %v", err)
+	}
+
+	server.Close()
+	s = store.NewS3Store(s3.New(aws.Auth{AccessKey: "access", SecretKey: "secret"}, region))
+	if _, err := s.GetReader("bucket", "abc"); store.KindOf(err) != store.ErrUnavailable {
+		t.Errorf("Expected an unavailable error; got %v", err)
+	}
+}
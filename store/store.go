@@ -12,6 +12,8 @@ type ImageStore interface {
 	PutReader(string, string, io.Reader, int64, string) error
 	Put(string, string, []byte, string) error
 	Head(string, string) (*http.Response, error)
+	Delete(string, string) error
+	List(string, string) ([]string, error)
 }
 
 type S3ImageStore struct {
@@ -23,17 +25,44 @@ func NewS3Store(conn *s3.S3) *S3ImageStore {
 }
 
 func (s *S3ImageStore) GetReader(bucket, path string) (io.ReadCloser, error) {
-	return s.conn.Bucket(bucket).GetReader(path)
+	r, err := s.conn.Bucket(bucket).GetReader(path)
+	return r, s3Error(err)
 }
 
 func (s *S3ImageStore) PutReader(bucket, path string, data io.Reader, length int64, content string) error {
-	return s.conn.Bucket(bucket).PutReader(path, data, length, content, s3.BucketOwnerRead)
+	return s3Error(s.conn.Bucket(bucket).PutReader(path, data, length, content, s3.BucketOwnerRead))
 }
 
 func (s *S3ImageStore) Put(bucket, path string, data []byte, content string) error {
-	return s.conn.Bucket(bucket).Put(path, data, content, s3.BucketOwnerRead)
+	return s3Error(s.conn.Bucket(bucket).Put(path, data, content, s3.BucketOwnerRead))
 }
 
 func (s *S3ImageStore) Head(bucket, path string) (*http.Response, error) {
-	return s.conn.Bucket(bucket).Head(path)
+	resp, err := s.conn.Bucket(bucket).Head(path)
+	return resp, s3Error(err)
+}
+
+func (s *S3ImageStore) Delete(bucket, path string) error {
+	return s3Error(s.conn.Bucket(bucket).Del(path))
+}
+
+func (s *S3ImageStore) List(bucket, prefix string) ([]string, error) {
+	var keys []string
+
+	marker := ""
+	for {
+		resp, err := s.conn.Bucket(bucket).List(prefix, "", marker, 0)
+		if err != nil {
+			return nil, s3Error(err)
+		}
+
+		for _, k := range resp.Contents {
+			keys = append(keys, k.Key)
+		}
+
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return keys, nil
+		}
+		marker = resp.Contents[len(resp.Contents)-1].Key
+	}
 }
@@ -0,0 +1,25 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+)
+
+// BombPNG is a tiny PNG whose header claims it's width x height, so
+// decoding it would allocate for the claimed size. Only the header is
+// valid; the image data is a single pixel.
+func BombPNG(width, height int) []byte {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+
+	// IHDR is the first chunk: length, type, then width and height
+	raw := buf.Bytes()
+	binary.BigEndian.PutUint32(raw[16:], uint32(width))
+	binary.BigEndian.PutUint32(raw[20:], uint32(height))
+	binary.BigEndian.PutUint32(raw[29:], crc32.ChecksumIEEE(raw[12:29]))
+
+	return raw
+}
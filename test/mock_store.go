@@ -6,10 +6,18 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vokal/vip/store"
 )
 
 type Store struct {
-	store map[string][]byte
+	sync.RWMutex
+	store    map[string][]byte
+	modified map[string]time.Time
 }
 
 type MockCloser struct {
@@ -22,14 +30,17 @@ func (m MockCloser) Close() error {
 
 func NewStore() *Store {
 	return &Store{
-		store: make(map[string][]byte),
+		store:    make(map[string][]byte),
+		modified: make(map[string]time.Time),
 	}
 }
 
 func (s *Store) GetReader(bucket, path string) (io.ReadCloser, error) {
+	s.RLock()
 	data := s.store[fmt.Sprintf("%s|%s", bucket, path)]
+	s.RUnlock()
 	if data == nil {
-		return nil, errors.New("item doesn't exist")
+		return nil, &store.Error{Kind: store.ErrNotFound, Err: errors.New("item doesn't exist")}
 	}
 
 	return MockCloser{bytes.NewBuffer(data)}, nil
@@ -38,15 +49,60 @@ func (s *Store) GetReader(bucket, path string) (io.ReadCloser, error) {
 func (s *Store) PutReader(bucket, path string, data io.Reader, length int64, content string) error {
 	var buf bytes.Buffer
 	buf.ReadFrom(data)
+	s.Lock()
 	s.store[fmt.Sprintf("%s|%s", bucket, path)] = buf.Bytes()
+	s.modified[fmt.Sprintf("%s|%s", bucket, path)] = time.Now()
+	s.Unlock()
 	return nil
 }
 
 func (s *Store) Put(bucket, path string, data []byte, content string) error {
+	s.Lock()
 	s.store[fmt.Sprintf("%s|%s", bucket, path)] = data
+	s.modified[fmt.Sprintf("%s|%s", bucket, path)] = time.Now()
+	s.Unlock()
 	return nil
 }
 
 func (s *Store) Head(bucket, path string) (*http.Response, error) {
-	return nil, errors.New("")
+	s.RLock()
+	data := s.store[fmt.Sprintf("%s|%s", bucket, path)]
+	modified := s.modified[fmt.Sprintf("%s|%s", bucket, path)]
+	s.RUnlock()
+	if data == nil {
+		return nil, &store.Error{Kind: store.ErrNotFound, Err: errors.New("item doesn't exist")}
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", http.DetectContentType(data))
+	header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       MockCloser{bytes.NewReader(nil)},
+	}, nil
+}
+
+func (s *Store) Delete(bucket, path string) error {
+	s.Lock()
+	delete(s.store, fmt.Sprintf("%s|%s", bucket, path))
+	delete(s.modified, fmt.Sprintf("%s|%s", bucket, path))
+	s.Unlock()
+	return nil
+}
+
+func (s *Store) List(bucket, prefix string) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var keys []string
+	for k := range s.store {
+		if strings.HasPrefix(k, fmt.Sprintf("%s|%s", bucket, prefix)) {
+			keys = append(keys, strings.TrimPrefix(k, bucket+"|"))
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
 }
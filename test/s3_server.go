@@ -0,0 +1,123 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type s3Object struct {
+	data     []byte
+	content  string
+	modified time.Time
+}
+
+// S3Server is a minimal stand-in for an S3-compatible service like
+// MinIO. It only understands path-style addressing, so requests that
+// put the bucket in the hostname fail.
+type S3Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]s3Object
+}
+
+func NewS3Server() *S3Server {
+	s := &S3Server{
+		objects: make(map[string]s3Object),
+	}
+	s.Server = httptest.NewServer(s)
+
+	return s
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS ") {
+		s3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		s3Error(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+	key := parts[0] + "/" + parts[1]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case parts[1] == "" && r.Method == "GET":
+		s.list(w, parts[0], r.URL.Query().Get("prefix"))
+		return
+	case parts[1] == "":
+		s3Error(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = s3Object{data, r.Header.Get("Content-Type"), time.Now()}
+
+	case "GET", "HEAD":
+		obj, ok := s.objects[key]
+		if !ok {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("Content-Type", obj.content)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		if r.Method == "GET" {
+			w.Write(obj.data)
+		}
+
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list returns every matching key in one page, sorted like S3 does.
+func (s *S3Server) list(w http.ResponseWriter, bucket, prefix string) {
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, bucket+"/"+prefix) {
+			keys = append(keys, strings.TrimPrefix(k, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<ListBucketResult><Name>%s</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>", bucket, prefix)
+	for _, k := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", k)
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -10,6 +12,8 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/vokal/vip/config"
+	"github.com/vokal/vip/fetch"
 	"github.com/vokal/vip/test"
 	. "gopkg.in/check.v1"
 )
@@ -95,6 +99,182 @@ func (s *UploadSuite) TestUploadWarmup(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *UploadSuite) TestUploadPlaceholder(c *C) {
+	authToken = "lalalatokenlalala"
+
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+
+	file, err := ioutil.ReadFile("./test/exif_test_img.jpg")
+	c.Assert(err, IsNil)
+
+	for _, header := range []string{"", "true"} {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload/samplebucket", bytes.NewReader(file))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "image/jpeg")
+		req.Header.Set("X-Vip-Token", authToken)
+		if header != "" {
+			req.Header.Set("X-Vip-Placeholder", header)
+		}
+
+		m.ServeHTTP(recorder, req)
+		c.Assert(recorder.Code, Equals, http.StatusCreated)
+
+		var u map[string]string
+		c.Assert(json.NewDecoder(recorder.Body).Decode(&u), IsNil)
+
+		if header == "" {
+			c.Check(u["blurhash"], Equals, "")
+			c.Check(u["lqip"], Equals, "")
+			continue
+		}
+
+		// The upload is rotated upright, so the hash has three
+		// components across and four down
+		c.Check(u["blurhash"], HasLen, 28)
+		c.Check(u["blurhash"][:1], Equals, "T")
+		c.Check(strings.HasPrefix(u["lqip"], "data:image/jpeg;base64,"), Equals, true)
+	}
+}
+
+func (s *UploadSuite) TestUploadFocalPoint(c *C) {
+	authToken = "lalalatokenlalala"
+
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+	m.HandleFunc("/{bucket_id}/{image_id}", handleImageRequest)
+
+	file, err := ioutil.ReadFile("./test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	upload := func(focal string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload/samplebucket", bytes.NewReader(file))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "image/jpeg")
+		req.Header.Set("X-Vip-Token", authToken)
+		req.Header.Set("X-Vip-Focal-Point", focal)
+		m.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	get := func(uri string) []byte {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", uri, nil)
+		c.Assert(err, IsNil)
+		m.ServeHTTP(recorder, req)
+		c.Assert(recorder.Code, Equals, http.StatusOK)
+		return recorder.Body.Bytes()
+	}
+
+	c.Assert(upload("0.9").Code, Equals, http.StatusBadRequest)
+	c.Assert(upload("0.9,1.2").Code, Equals, http.StatusBadRequest)
+
+	recorder := upload("0.9,0.2")
+	c.Assert(recorder.Code, Equals, http.StatusCreated)
+
+	var u UploadResponse
+	c.Assert(json.NewDecoder(recorder.Body).Decode(&u), IsNil)
+	uri, err := url.Parse(u.Url)
+	c.Assert(err, IsNil)
+	id := strings.TrimPrefix(uri.Path, "/samplebucket/")
+
+	focal, err := fetch.ReadFocalPoint(storage, "samplebucket", id)
+	c.Assert(err, IsNil)
+	c.Assert(*focal, Equals, fetch.FocalPoint{X: 0.9, Y: 0.2})
+
+	// Crops without a gravity of their own use the stored focal point
+	stored := get("http://localhost:8080/samplebucket/" + id + "?s=100&c=true")
+	explicit := get("http://localhost:8080/samplebucket/" + id + "?s=100&c=true&fx=0.9&fy=0.2")
+	c.Assert(stored, DeepEquals, explicit)
+}
+
+func (s *UploadSuite) TestUploadSigned(c *C) {
+	authToken = "lalalatokenlalala"
+	signingKey = "lalalasecretlalala"
+	defer func() { signingKey = "" }()
+
+	recorder := httptest.NewRecorder()
+
+	// Mock up a router so that mux.Vars are passed
+	// correctly
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+	f, err := os.Open("./test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/upload/samplebucket", f)
+	c.Assert(err, IsNil)
+	fstat, err := os.Stat("./test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+	req.ContentLength = fstat.Size()
+	req.Header.Set("X-Vip-Warmup", "s=100&c=true, s=200")
+	req.Header.Set("Content-Type", "image/jpeg")
+	req.Header.Set("X-Vip-Token", authToken)
+
+	m.ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusCreated)
+
+	var u UploadResponse
+	err = json.NewDecoder(recorder.Body).Decode(&u)
+	c.Assert(err, IsNil)
+
+	uri, err := url.Parse(u.Url)
+	c.Assert(err, IsNil)
+	c.Assert(verifySignature("samplebucket", uri.Path, uri.Query()), Equals, true)
+
+	c.Assert(len(u.Variants), Equals, 2)
+	for query, variant := range u.Variants {
+		uri, err := url.Parse(variant)
+		c.Assert(err, IsNil)
+		c.Assert(verifySignature("samplebucket", uri.Path, uri.Query()), Equals, true)
+
+		expected, err := url.ParseQuery(query)
+		c.Assert(err, IsNil)
+		c.Assert(uri.Query().Get("s"), Equals, expected.Get("s"))
+	}
+}
+
+func (s *UploadSuite) TestUploadBucketSettings(c *C) {
+	authToken = "lalalatokenlalala"
+	origins = nil
+
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+	defer config.Set(nil)
+
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+
+	upload := func(bucket, token, file string) *httptest.ResponseRecorder {
+		f, err := os.Open(file)
+		c.Assert(err, IsNil)
+		fstat, err := os.Stat(file)
+		c.Assert(err, IsNil)
+
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload/"+bucket, f)
+		c.Assert(err, IsNil)
+		req.ContentLength = fstat.Size()
+		req.Header.Set("Content-Type", "image/jpeg")
+		req.Header.Set("X-Vip-Token", token)
+
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	c.Assert(upload("otherbucket", authToken, "./test/awesome-small.jpg").Code, Equals, http.StatusNotFound)
+
+	// The bucket's own token replaces the global one
+	c.Assert(upload("avatars", authToken, "./test/awesome-small.jpg").Code, Equals, http.StatusUnauthorized)
+	c.Assert(upload("avatars", "avatartoken", "./test/awesome-small.jpg").Code, Equals, http.StatusCreated)
+
+	// The bucket has a 1MB limit
+	c.Assert(upload("avatars", "avatartoken", "./test/exif_test_img.jpg").Code, Equals, http.StatusRequestEntityTooLarge)
+}
+
 func (s *UploadSuite) TestEmptyUpload(c *C) {
 	authToken = "lalalatokenlalala"
 	os.Setenv("ALLOWED_ORIGIN", "")
@@ -146,6 +326,27 @@ func (s *UploadSuite) TestUnauthorizedUpload(c *C) {
 	c.Assert(recorder.Code, Equals, http.StatusUnauthorized)
 }
 
+func (s *UploadSuite) TestUploadWithoutToken(c *C) {
+	authToken = ""
+	origins = nil
+
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+
+	file, err := ioutil.ReadFile("./test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	// With no token configured, an empty one doesn't match it
+	req, err := http.NewRequest("POST", "http://localhost:8080/upload/samplebucket", bytes.NewReader(file))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "image/jpeg")
+	req.Header.Set("X-Vip-Token", "")
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusUnauthorized)
+}
+
 func (s *UploadSuite) TestSetOriginData(c *C) {
 	authToken = "heyheyheyimatoken"
 	origins = []string{"localhost", "*.vokal.io"}
@@ -238,7 +439,246 @@ func (s *UploadSuite) TestContentLengthPng(c *C) {
 	fstat, err := os.Stat("./test/test_inspiration.png")
 	c.Assert(err, IsNil)
 
+	// Only the 530 byte XMP chunk is removed by default
 	data, err := processFile(f, "image/png", "")
 	c.Assert(err, IsNil)
+	c.Assert(data.Length, Equals, fstat.Size()-530)
+}
+
+func (s *UploadSuite) TestMetadataPolicy(c *C) {
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+	defer config.Set(nil)
+
+	fstat, err := os.Stat("./test/test_inspiration.png")
+	c.Assert(err, IsNil)
+
+	f, err := os.Open("./test/test_inspiration.png")
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	// The private bucket keeps metadata
+	data, err := processFile(f, "image/png", "private")
+	c.Assert(err, IsNil)
 	c.Assert(data.Length, Equals, fstat.Size())
+
+	// EXIF and IPTC are removed from JPEGs, while the color profile
+	// and the image itself are untouched
+	file, err := ioutil.ReadFile("./test/awesome.jpeg")
+	c.Assert(err, IsNil)
+	data, err = processFile(bytes.NewReader(file), "image/jpeg", "samplebucket")
+	c.Assert(err, IsNil)
+
+	stripped, err := ioutil.ReadAll(data.Data)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(stripped, []byte("Exif\x00\x00")), Equals, false)
+	c.Assert(bytes.Contains(stripped, []byte("Photoshop 3.0")), Equals, false)
+	c.Assert(bytes.Contains(stripped, []byte("ICC_PROFILE")), Equals, true)
+
+	// The compressed image data is copied untouched
+	c.Assert(bytes.HasSuffix(stripped, file[len(file)-100000:]), Equals, true)
+}
+
+func (s *UploadSuite) TestMalformedMetadata(c *C) {
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+	defer config.Set(nil)
+
+	file, err := ioutil.ReadFile("./test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	// An APP1 segment ending partway through its TIFF header
+	segment := append([]byte{0xff, 0xe1, 0, 12}, "Exif\x00\x00MM\x00\x2a"...)
+	truncated := append(append(append([]byte{}, file[:2]...), segment...), file[2:]...)
+
+	// Location data can't be found in it to remove
+	_, err = processFile(bytes.NewReader(truncated), "image/jpeg", "places")
+	c.Assert(err, NotNil)
+	c.Assert(err.(*uploadError).status, Equals, http.StatusUnprocessableEntity)
+
+	// Stripping everything drops the segment whole
+	data, err := processFile(bytes.NewReader(truncated), "image/jpeg", "samplebucket")
+	c.Assert(err, IsNil)
+	stripped, err := ioutil.ReadAll(data.Data)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(stripped, []byte("Exif\x00\x00")), Equals, false)
+}
+
+func (s *UploadSuite) TestUploadDedupe(c *C) {
+	authToken = "lalalatokenlalala"
+
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+	defer config.Set(nil)
+
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+	m.HandleFunc("/{bucket_id}/{image_id}", handleImageRequest)
+
+	upload := func(bucket, filename string) (int, string) {
+		file, err := ioutil.ReadFile(filename)
+		c.Assert(err, IsNil)
+
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload/"+bucket, bytes.NewReader(file))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", http.DetectContentType(file))
+		req.Header.Set("X-Vip-Token", authToken)
+		m.ServeHTTP(recorder, req)
+
+		var u UploadResponse
+		c.Assert(json.NewDecoder(recorder.Body).Decode(&u), IsNil)
+		return recorder.Code, u.Url
+	}
+
+	code, first := upload("gallery", "./test/awesome-small.jpg")
+	c.Assert(code, Equals, http.StatusCreated)
+	c.Assert(first, Matches, "http://localhost:8080/gallery/[0-9a-f]{64}-240x150")
+
+	// The same image again is found rather than stored twice
+	code, second := upload("gallery", "./test/awesome-small.jpg")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(second, Equals, first)
+
+	code, other := upload("gallery", "./test/test_inspiration.png")
+	c.Assert(code, Equals, http.StatusCreated)
+	c.Assert(other, Not(Equals), first)
+
+	// Buckets without dedupe still get a new key every time
+	_, a := upload("samplebucket", "./test/awesome-small.jpg")
+	_, b := upload("samplebucket", "./test/awesome-small.jpg")
+	c.Assert(a, Not(Equals), b)
+
+	// A deleted image can be uploaded again under the same key
+	uri, err := url.Parse(first)
+	c.Assert(err, IsNil)
+	id := strings.TrimPrefix(uri.Path, "/gallery/")
+	c.Assert(storage.Delete("gallery", id), IsNil)
+	deleted.Add("gallery", id)
+
+	code, third := upload("gallery", "./test/awesome-small.jpg")
+	c.Assert(code, Equals, http.StatusCreated)
+	c.Assert(third, Equals, first)
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", first, nil)
+	c.Assert(err, IsNil)
+	m.ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+}
+
+func (s *UploadSuite) TestBatchUpload(c *C) {
+	authToken = "lalalatokenlalala"
+
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+
+	files := [][2]string{
+		{"photo.jpg", "./test/awesome-small.jpg"},
+		{"notes.txt", "./main.go"},
+		{"empty.png", ""},
+		{"inspiration.png", "./test/test_inspiration.png"},
+	}
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	c.Assert(form.WriteField("caption", "ignored"), IsNil)
+	for _, f := range files {
+		part, err := form.CreateFormFile("images", f[0])
+		c.Assert(err, IsNil)
+		if f[1] != "" {
+			file, err := ioutil.ReadFile(f[1])
+			c.Assert(err, IsNil)
+			part.Write(file)
+		}
+	}
+	c.Assert(form.Close(), IsNil)
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "http://localhost:8080/upload/samplebucket", bytes.NewReader(body.Bytes()))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-Vip-Token", authToken)
+	req.Header.Set("X-Vip-Warmup", "s=100")
+	m.ServeHTTP(recorder, req)
+
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	c.Assert(recorder.HeaderMap.Get("Content-Type"), Equals, "application/json")
+
+	var u []UploadResponse
+	c.Assert(json.NewDecoder(recorder.Body).Decode(&u), IsNil)
+	c.Assert(u, HasLen, 4)
+
+	// A bad file doesn't stop the rest of the batch
+	c.Check(u[0].Filename, Equals, "photo.jpg")
+	c.Check(u[0].Url, Matches, "http://localhost:8080/samplebucket/[0-9a-f]+-240x150")
+	c.Check(u[0].Variants, HasLen, 1)
+	c.Check(u[0].Error, Equals, "")
+
+	c.Check(u[1].Filename, Equals, "notes.txt")
+	c.Check(u[1].Url, Equals, "")
+	c.Check(u[1].Error, Not(Equals), "")
+
+	c.Check(u[2].Error, Equals, "File must have size greater than 0")
+
+	c.Check(u[3].Filename, Equals, "inspiration.png")
+	c.Check(u[3].Url, Matches, "http://localhost:8080/samplebucket/[0-9a-f]+-[0-9]+x[0-9]+")
+
+	// Each file is stored with its own type
+	uri, err := url.Parse(u[3].Url)
+	c.Assert(err, IsNil)
+	resp, err := storage.Head("samplebucket", strings.TrimPrefix(uri.Path, "/samplebucket/"))
+	c.Assert(err, IsNil)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "image/png")
+}
+
+func (s *UploadSuite) TestBatchUploadLimits(c *C) {
+	authToken = "lalalatokenlalala"
+
+	defer func(n int) { batchLimit = n }(batchLimit)
+	batchLimit = 2
+
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+
+	file, err := ioutil.ReadFile("./test/awesome-small.jpg")
+	c.Assert(err, IsNil)
+
+	upload := func(n int) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		form := multipart.NewWriter(body)
+		for i := 0; i < n; i++ {
+			part, err := form.CreateFormFile("images", "photo.jpg")
+			c.Assert(err, IsNil)
+			part.Write(file)
+		}
+		c.Assert(form.Close(), IsNil)
+
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload/samplebucket", body)
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("X-Vip-Token", authToken)
+		m.ServeHTTP(recorder, req)
+
+		return recorder
+	}
+
+	// Files past the limit are reported rather than stored
+	recorder := upload(3)
+	c.Assert(recorder.Code, Equals, http.StatusOK)
+	var u []UploadResponse
+	c.Assert(json.NewDecoder(recorder.Body).Decode(&u), IsNil)
+	c.Assert(u, HasLen, 3)
+	c.Check(u[0].Url, Not(Equals), "")
+	c.Check(u[1].Url, Not(Equals), "")
+	c.Check(u[2].Url, Equals, "")
+	c.Check(u[2].Error, Equals, "Only 2 files can be uploaded at once")
+
+	// A form without files is a bad request
+	recorder = upload(0)
+	c.Assert(recorder.Code, Equals, http.StatusBadRequest)
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/vokal/vip/config"
+)
+
+// uploadError is an upload that was refused, along with the status
+// to refuse it with.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+// sniffFormat names an upload's format from its magic bytes, ignoring
+// whatever Content-Type the client sent.
+func sniffFormat(raw []byte) string {
+	content := http.DetectContentType(raw)
+	if !strings.HasPrefix(content, "image/") {
+		return ""
+	}
+
+	return strings.TrimPrefix(content, "image/")
+}
+
+func validateFormat(v *config.Validation, format string) error {
+	if format == "" {
+		return &uploadError{http.StatusUnsupportedMediaType, "The file is not a recognized image format"}
+	}
+	if !v.AllowsFormat(format) {
+		return &uploadError{
+			http.StatusUnsupportedMediaType,
+			fmt.Sprintf("%s images are not accepted; use %s", format, strings.Join(v.Formats, ", ")),
+		}
+	}
+
+	return nil
+}
+
+func validateSize(v *config.Validation, width, height int) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &uploadError{http.StatusUnprocessableEntity, fmt.Sprintf(format, args...)}
+	}
+
+	switch {
+	case v.MinWidth > 0 && width < v.MinWidth:
+		return invalid("The image must be at least %dpx wide", v.MinWidth)
+	case v.MinHeight > 0 && height < v.MinHeight:
+		return invalid("The image must be at least %dpx tall", v.MinHeight)
+	case v.MaxWidth > 0 && width > v.MaxWidth:
+		return invalid("The image must be at most %dpx wide", v.MaxWidth)
+	case v.MaxHeight > 0 && height > v.MaxHeight:
+		return invalid("The image must be at most %dpx tall", v.MaxHeight)
+	}
+
+	if megapixels := float64(width*height) / 1e6; v.MaxMegapixels > 0 && megapixels > v.MaxMegapixels {
+		return invalid("The image must be at most %g megapixels", v.MaxMegapixels)
+	}
+
+	long, short := width, height
+	if short > long {
+		long, short = short, long
+	}
+	if v.MaxAspectRatio > 0 && float64(long) > v.MaxAspectRatio*float64(short) {
+		return invalid("The image's aspect ratio must be at most %g:1", v.MaxAspectRatio)
+	}
+
+	return nil
+}
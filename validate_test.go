@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gorilla/mux"
+	"github.com/vokal/vip/config"
+	"github.com/vokal/vip/test"
+	. "gopkg.in/check.v1"
+)
+
+var (
+	_ = Suite(&ValidateSuite{})
+)
+
+type ValidateSuite struct{}
+
+func (s *ValidateSuite) SetUpSuite(c *C) {
+	setUpSuite(c)
+}
+
+func (s *ValidateSuite) SetUpTest(c *C) {
+	setUpTest(c)
+
+	storage = test.NewStore()
+
+	registry, err := config.Load("test/buckets.json")
+	c.Assert(err, IsNil)
+	config.Set(registry)
+}
+
+func (s *ValidateSuite) TearDownTest(c *C) {
+	config.Set(nil)
+}
+
+func blankPng(c *C, width, height int) []byte {
+	buf := new(bytes.Buffer)
+	c.Assert(png.Encode(buf, image.NewGray(image.Rect(0, 0, width, height))), IsNil)
+	return buf.Bytes()
+}
+
+func (s *ValidateSuite) TestValidation(c *C) {
+	gif, err := ioutil.ReadFile("./test/animated.gif")
+	c.Assert(err, IsNil)
+
+	cases := []struct {
+		name   string
+		file   []byte
+		status int
+	}{
+		{"avatar", blankPng(c, 200, 150), 0},
+		{"text", []byte("not an image at all"), http.StatusUnsupportedMediaType},
+		{"gif", gif, http.StatusUnsupportedMediaType},
+		{"tracking pixel", blankPng(c, 1, 1), http.StatusUnprocessableEntity},
+		{"short", blankPng(c, 100, 63), http.StatusUnprocessableEntity},
+		{"wide", blankPng(c, 4097, 3000), http.StatusUnprocessableEntity},
+		{"tall", blankPng(c, 3000, 4097), http.StatusUnprocessableEntity},
+		{"megapixels", blankPng(c, 3500, 3500), http.StatusUnprocessableEntity},
+		{"panorama", blankPng(c, 1000, 300), http.StatusUnprocessableEntity},
+		{"portrait strip", blankPng(c, 300, 1000), http.StatusUnprocessableEntity},
+		// Refused from its header, before the broken image data is read
+		{"short header", test.BombPNG(100, 63), http.StatusUnprocessableEntity},
+		{"decode bomb", test.BombPNG(50000, 50000), http.StatusUnprocessableEntity},
+	}
+
+	for _, t := range cases {
+		_, err := processFile(bytes.NewReader(t.file), "image/png", "avatars")
+		if t.status == 0 {
+			c.Check(err, IsNil, Commentf(t.name))
+			continue
+		}
+
+		e, ok := err.(*uploadError)
+		c.Assert(ok, Equals, true, Commentf("%s: %v", t.name, err))
+		c.Check(e.status, Equals, t.status, Commentf(t.name))
+	}
+
+	// Other buckets take anything that decodes
+	_, err = processFile(bytes.NewReader(gif), "image/gif", "samplebucket")
+	c.Assert(err, IsNil)
+	_, err = processFile(bytes.NewReader(blankPng(c, 1, 1)), "image/png", "samplebucket")
+	c.Assert(err, IsNil)
+}
+
+func (s *ValidateSuite) TestFormatIgnoresContentType(c *C) {
+	// A PNG labelled as a GIF is still a PNG
+	_, err := processFile(bytes.NewReader(blankPng(c, 100, 100)), "image/gif", "avatars")
+	c.Assert(err, IsNil)
+
+	// A PNG labelled as a JPEG is refused as a bad JPEG
+	_, err = processFile(bytes.NewReader(blankPng(c, 100, 100)), "image/jpeg", "avatars")
+	c.Assert(err, FitsTypeOf, &uploadError{})
+}
+
+func (s *ValidateSuite) TestValidationResponse(c *C) {
+	m := mux.NewRouter()
+	m.Handle("/upload/{bucket_id}", verifyAuth(handleUpload))
+
+	for file, status := range map[string]int{
+		"./test/animated.gif":      http.StatusUnsupportedMediaType,
+		"./test/awesome-small.jpg": http.StatusCreated,
+	} {
+		data, err := ioutil.ReadFile(file)
+		c.Assert(err, IsNil)
+
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload/avatars", bytes.NewReader(data))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "image/jpeg")
+		req.Header.Set("X-Vip-Token", "avatartoken")
+
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, req)
+		c.Assert(recorder.Code, Equals, status)
+		c.Assert(recorder.HeaderMap.Get("Content-Type"), Equals, "application/json")
+	}
+
+	// A panorama is refused with a JSON error
+	req, err := http.NewRequest("POST", "http://localhost:8080/upload/avatars", bytes.NewReader(blankPng(c, 2000, 200)))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("X-Vip-Token", "avatartoken")
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, req)
+	c.Assert(recorder.Code, Equals, http.StatusUnprocessableEntity)
+
+	var e ErrorResponse
+	c.Assert(json.NewDecoder(recorder.Body).Decode(&e), IsNil)
+	c.Assert(e.Msg, Equals, "The image's aspect ratio must be at most 2:1")
+}